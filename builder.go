@@ -0,0 +1,186 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"encoding/xml"
+	"strconv"
+)
+
+// Builder constructs an element and its content through chained calls:
+//
+//	doc := xmlx.New().Build(
+//		xmlx.E("urn:shop", "order").Attr("id", "1").Child(
+//			xmlx.E("urn:shop", "item").Text("x"),
+//		),
+//	)
+//
+// Namespaces are declared automatically when the tree is built: an element
+// in a namespace which is not in scope declares it as the default namespace,
+// and a namespaced attribute gets a generated prefix. (ns1, ns2, ...) So does
+// an element declaring another default namespace with NS. Use NS to declare a
+// prefix of your own choice instead.
+type Builder struct {
+	node *Node
+}
+
+// Returns a builder for an element with the given namespace uri and name.
+func E(namespace, name string) *Builder {
+	n := NewNode(NT_ELEMENT)
+	n.Name = xml.Name{Space: namespace, Local: name}
+	return &Builder{node: n}
+}
+
+// Add an attribute without namespace.
+func (this *Builder) Attr(name, value string) *Builder {
+	return this.AttrNS("", name, value)
+}
+
+// Add an attribute with the given namespace uri.
+func (this *Builder) AttrNS(namespace, name, value string) *Builder {
+	this.node.SetAttrNS(namespace, name, value)
+	return this
+}
+
+// Declare a namespace prefix on the element.
+func (this *Builder) NS(prefix, namespace string) *Builder {
+	if len(prefix) == 0 {
+		return this.AttrNS("", "xmlns", namespace)
+	}
+	return this.AttrNS("xmlns", prefix, namespace)
+}
+
+// Add a text node.
+func (this *Builder) Text(s string) *Builder {
+	return this.add(NT_TEXT, "", s)
+}
+
+// Add a comment.
+func (this *Builder) Comment(s string) *Builder {
+	return this.add(NT_COMMENT, "", s)
+}
+
+// Add a processing instruction.
+func (this *Builder) ProcInst(target, value string) *Builder {
+	return this.add(NT_PROCINST, target, value)
+}
+
+// Add the elements of the given builders as children.
+func (this *Builder) Child(children ...*Builder) *Builder {
+	for _, c := range children {
+		this.node.AddChild(c.node)
+	}
+	return this
+}
+
+// Add existing nodes as children. Nodes with a parent are moved.
+func (this *Builder) Append(nodes ...*Node) *Builder {
+	for _, n := range nodes {
+		this.node.AddChild(n)
+	}
+	return this
+}
+
+// Returns the element, with the namespace declarations it needs added to it
+// and its descendants.
+func (this *Builder) Node() *Node {
+	declareUsed(this.node, inheritedNamespaces(this.node.Parent))
+	return this.node
+}
+
+func (this *Builder) add(typ byte, target, value string) *Builder {
+	n := NewNode(typ)
+	n.Target = target
+	n.Value = value
+	this.node.AddChild(n)
+	return this
+}
+
+// Replace the content of this document with the elements of the given
+// builders. Returns the document.
+func (this *Document) Build(nodes ...*Builder) *Document {
+	root := NewNode(NT_ROOT)
+	for _, b := range nodes {
+		root.AddChild(b.Node())
+	}
+	this.setRoot(root)
+	return this
+}
+
+// Create a new document with the given node as its document element.
+func NewDocumentWithRoot(root *Node) *Document {
+	doc := New()
+	doc.Root = NewNode(NT_ROOT)
+	doc.Root.AddChild(root)
+	return doc
+}
+
+// declareUsed adds declarations for the namespaces used by n and its
+// descendants which are not in scope. inscope holds the namespaces in scope
+// for the parent of n.
+func declareUsed(n *Node, inscope map[string]string) {
+	if n.Type != NT_ELEMENT {
+		return
+	}
+
+	inscope = applyNamespaces(inscope, n)
+
+	// An explicit default namespace declaration is left alone; an element
+	// in another namespace gets a prefix instead.
+	explicit := false
+	for _, a := range n.Attributes {
+		explicit = explicit || len(a.Name.Space) == 0 && a.Name.Local == "xmlns"
+	}
+
+	switch space := n.Name.Space; {
+	case len(space) > 0 && space != nsXML && !isBound(inscope, space, true):
+		if explicit {
+			inscope = declarePrefix(n, inscope, space)
+		} else {
+			n.Attributes = append(n.Attributes, &Attr{Name: xml.Name{Local: "xmlns"}, Value: space})
+			inscope = applyNamespaces(inscope, n)
+		}
+	case len(space) == 0 && len(inscope[""]) > 0 && !explicit:
+		n.Attributes = append(n.Attributes, &Attr{Name: xml.Name{Local: "xmlns"}})
+		inscope = applyNamespaces(inscope, n)
+	}
+
+	for _, a := range n.Attributes {
+		space := a.Name.Space
+		if len(space) == 0 || space == nsXML || isNamespaceDecl(a) || isBound(inscope, space, false) {
+			continue
+		}
+		inscope = declarePrefix(n, inscope, space)
+	}
+
+	for _, v := range n.Children {
+		declareUsed(v, inscope)
+	}
+}
+
+// declarePrefix adds a declaration of a generated prefix for the given
+// namespace to n. Returns the namespaces in scope for n after that.
+func declarePrefix(n *Node, inscope map[string]string, space string) map[string]string {
+	prefix := ""
+	for i := 1; len(prefix) == 0; i++ {
+		if _, ok := inscope["ns"+strconv.Itoa(i)]; !ok {
+			prefix = "ns" + strconv.Itoa(i)
+		}
+	}
+
+	n.Attributes = append(n.Attributes, &Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: space})
+	return applyNamespaces(inscope, n)
+}
+
+// isBound returns true if a prefix for the given namespace is in scope. If def
+// is set, the default namespace counts as well.
+func isBound(inscope map[string]string, space string, def bool) bool {
+	for p, uri := range inscope {
+		if uri == space && (def || len(p) > 0) {
+			return true
+		}
+	}
+	return false
+}
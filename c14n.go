@@ -0,0 +1,390 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Canonicalization methods supported by Node.Canonicalize.
+const (
+	C14N_10                 = iota // Canonical XML 1.0, omitting comments.
+	C14N_10_COMMENTS               // Canonical XML 1.0 with comments.
+	C14N_EXCLUSIVE                 // Exclusive XML Canonicalization 1.0, omitting comments.
+	C14N_EXCLUSIVE_COMMENTS        // Exclusive XML Canonicalization 1.0 with comments.
+)
+
+// Write the canonical form of this node and its descendants to the supplied
+// writer, using one of the C14N_* methods. If the node is the root of a
+// document, the whole document is written. If it is an element, the subtree
+// starting at it is written, taking namespace declarations and, for Canonical
+// XML 1.0, xml:* attributes of its ancestors into account.
+//
+// For exclusive canonicalization, inclusivePrefixes holds the prefixes to be
+// treated as in Canonical XML 1.0, the InclusiveNamespaces PrefixList. Use
+// "#default" for the default namespace.
+//
+// Note that the parser trims comments and processing instructions, and does
+// not apply attribute defaults from the DTD. The canonical form is produced
+// from the tree as it is.
+func (this *Node) Canonicalize(w io.Writer, mode byte, inclusivePrefixes ...string) error {
+	c := &canonicalizer{Writer: bufio.NewWriter(w)}
+
+	switch mode {
+	case C14N_10:
+	case C14N_10_COMMENTS:
+		c.comments = true
+	case C14N_EXCLUSIVE, C14N_EXCLUSIVE_COMMENTS:
+		c.exclusive = true
+		c.comments = mode == C14N_EXCLUSIVE_COMMENTS
+		c.inclusive = make(map[string]bool)
+		for _, p := range inclusivePrefixes {
+			if p == "#default" {
+				p = ""
+			}
+			c.inclusive[p] = true
+		}
+	default:
+		return fmt.Errorf("xmlx: unknown canonicalization method %d", mode)
+	}
+
+	switch this.Type {
+	case NT_ROOT:
+		c.document(this)
+	case NT_ELEMENT:
+		c.element(this, nil, inheritedNamespaces(this.Parent), true)
+	default:
+		c.node(this, nil, nil)
+	}
+
+	if c.err != nil {
+		return c.err
+	}
+	return c.Flush()
+}
+
+type canonicalizer struct {
+	*bufio.Writer
+	exclusive bool
+	comments  bool
+	inclusive map[string]bool // Prefixes treated inclusively in exclusive mode.
+	err       error
+}
+
+// A namespace declaration.
+type nsDecl struct {
+	prefix string
+	uri    string
+}
+
+func (this *canonicalizer) document(n *Node) {
+	after := false
+	for _, v := range n.Children {
+		switch v.Type {
+		case NT_ELEMENT:
+			this.element(v, nil, nil, true)
+			after = true
+		case NT_COMMENT, NT_PROCINST:
+			if v.Type == NT_COMMENT && !this.comments {
+				continue
+			}
+			if after {
+				this.WriteByte('\n')
+			}
+			this.node(v, nil, nil)
+			if !after {
+				this.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// node writes a child node. rendered and inscope hold the namespaces of the
+// parent, if it is an element.
+func (this *canonicalizer) node(n *Node, rendered, inscope map[string]string) {
+	switch n.Type {
+	case NT_ELEMENT:
+		this.element(n, rendered, inscope, false)
+	case NT_TEXT:
+		this.escape(n.Value, false)
+	case NT_COMMENT:
+		if this.comments {
+			this.WriteString("<!--")
+			this.WriteString(n.Value)
+			this.WriteString("-->")
+		}
+	case NT_PROCINST:
+		this.WriteString("<?")
+		this.WriteString(n.Target)
+		if len(n.Value) > 0 {
+			this.WriteByte(' ')
+			this.WriteString(n.Value)
+		}
+		this.WriteString("?>")
+	}
+}
+
+// element writes element n. rendered holds the namespace declarations written
+// by its output ancestors, inscope all namespaces in scope for its parent.
+func (this *canonicalizer) element(n *Node, rendered, inscope map[string]string, apex bool) {
+	inscope = applyNamespaces(inscope, n)
+
+	prefix, ok := "", true
+	if len(n.Name.Space) > 0 {
+		if prefix, ok = n.lookupPrefix(n.Name.Space, true); !ok {
+			prefix = this.fallbackPrefix(n, n.Name.Space)
+		}
+	}
+
+	// Namespaces used by the element and attribute names themselves.
+	used := make(map[string]string)
+	if ok {
+		used[prefix] = n.Name.Space
+	}
+
+	var attrs []*Attr
+	for _, a := range n.Attributes {
+		if isNamespaceDecl(a) {
+			continue
+		}
+		attrs = append(attrs, a)
+		if len(a.Name.Space) > 0 && a.Name.Space != nsXML {
+			if p, ok := n.lookupPrefix(a.Name.Space, false); ok {
+				used[p] = a.Name.Space
+			}
+		}
+	}
+
+	if this.exclusive {
+		for p := range this.inclusive {
+			if _, ok := used[p]; !ok {
+				if u, ok := inscope[p]; ok {
+					used[p] = u
+				}
+			}
+		}
+	} else {
+		for p, u := range inscope {
+			if _, ok := used[p]; !ok {
+				used[p] = u
+			}
+		}
+		if apex {
+			attrs = append(attrs, inheritedXMLAttrs(n)...)
+		}
+	}
+
+	var decls []nsDecl
+	for p, u := range used {
+		r, ok := rendered[p]
+		switch {
+		case p == "xml":
+		case len(p) == 0 && len(u) == 0:
+			// xmlns="" is only needed to undo a default namespace.
+			if ok && len(r) > 0 {
+				decls = append(decls, nsDecl{p, u})
+			}
+		case !ok || r != u:
+			decls = append(decls, nsDecl{p, u})
+		}
+	}
+
+	sort.Slice(decls, func(i, j int) bool { return decls[i].prefix < decls[j].prefix })
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].Name.Space != attrs[j].Name.Space {
+			return attrs[i].Name.Space < attrs[j].Name.Space
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+
+	if len(decls) > 0 {
+		r := make(map[string]string, len(rendered)+len(decls))
+		for p, u := range rendered {
+			r[p] = u
+		}
+		for _, d := range decls {
+			r[d.prefix] = d.uri
+		}
+		rendered = r
+	}
+
+	this.WriteByte('<')
+	this.name(prefix, n.Name.Local)
+
+	for _, d := range decls {
+		this.WriteString(" xmlns")
+		if len(d.prefix) > 0 {
+			this.WriteByte(':')
+			this.WriteString(d.prefix)
+		}
+		this.WriteString(`="`)
+		this.escape(d.uri, true)
+		this.WriteByte('"')
+	}
+
+	for _, a := range attrs {
+		this.WriteByte(' ')
+		if len(a.Name.Space) > 0 {
+			p, ok := n.lookupPrefix(a.Name.Space, false)
+			if !ok {
+				p = this.fallbackPrefix(n, a.Name.Space)
+			}
+			this.name(p, a.Name.Local)
+		} else {
+			this.WriteString(a.Name.Local)
+		}
+		this.WriteString(`="`)
+		this.escape(a.Value, true)
+		this.WriteByte('"')
+	}
+
+	this.WriteByte('>')
+
+	for _, v := range n.Children {
+		this.node(v, rendered, inscope)
+	}
+
+	this.escape(n.Value, false)
+	this.WriteString("</")
+	this.name(prefix, n.Name.Local)
+	this.WriteByte('>')
+}
+
+func (this *canonicalizer) name(prefix, local string) {
+	if len(prefix) > 0 {
+		this.WriteString(prefix)
+		this.WriteByte(':')
+	}
+	this.WriteString(local)
+}
+
+// fallbackPrefix handles a namespace without a declaration in scope. If it is
+// a valid prefix by itself, it is used as such; the document was most likely
+// parsed from a source lacking the declaration.
+func (this *canonicalizer) fallbackPrefix(n *Node, space string) string {
+	if !isNCName(space) {
+		this.fail(n, space)
+	}
+	return space
+}
+
+func (this *canonicalizer) fail(n *Node, space string) {
+	if this.err == nil {
+		this.err = nodeError(n, fmt.Sprintf("namespace %q has no prefix in scope", space))
+	}
+}
+
+// escape writes s, escaped as required for text or attribute values.
+func (this *canonicalizer) escape(s string, attr bool) {
+	last := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case '&':
+			esc = "&amp;"
+		case '<':
+			esc = "&lt;"
+		case '>':
+			if attr {
+				continue
+			}
+			esc = "&gt;"
+		case '"':
+			if !attr {
+				continue
+			}
+			esc = "&quot;"
+		case '\t':
+			if !attr {
+				continue
+			}
+			esc = "&#x9;"
+		case '\n':
+			if !attr {
+				continue
+			}
+			esc = "&#xA;"
+		case '\r':
+			esc = "&#xD;"
+		default:
+			continue
+		}
+		this.WriteString(s[last:i])
+		this.WriteString(esc)
+		last = i + 1
+	}
+	this.WriteString(s[last:])
+}
+
+// inheritedNamespaces returns the namespaces in scope for node n, as declared
+// by n and its ancestors.
+func inheritedNamespaces(n *Node) map[string]string {
+	var list []*Node
+	for ; n != nil; n = n.Parent {
+		list = append(list, n)
+	}
+
+	var inscope map[string]string
+	for i := len(list) - 1; i >= 0; i-- {
+		inscope = applyNamespaces(inscope, list[i])
+	}
+	return inscope
+}
+
+// applyNamespaces returns the namespaces in scope for n, given those in scope
+// for its parent. The parent's map is not modified.
+func applyNamespaces(inscope map[string]string, n *Node) map[string]string {
+	copied := false
+	for _, a := range n.Attributes {
+		if !isNamespaceDecl(a) {
+			continue
+		}
+
+		if !copied {
+			m := make(map[string]string, len(inscope)+1)
+			for p, u := range inscope {
+				m[p] = u
+			}
+			inscope, copied = m, true
+		}
+
+		prefix := ""
+		if a.Name.Space == "xmlns" {
+			prefix = a.Name.Local
+		}
+
+		if len(a.Value) == 0 && len(prefix) > 0 {
+			delete(inscope, prefix)
+		} else {
+			inscope[prefix] = a.Value
+		}
+	}
+	return inscope
+}
+
+// inheritedXMLAttrs returns the xml:* attributes of the ancestors of n which
+// are not overridden by n or a nearer ancestor.
+func inheritedXMLAttrs(n *Node) []*Attr {
+	var list []*Attr
+	seen := make(map[string]bool)
+	for _, a := range n.Attributes {
+		if a.Name.Space == nsXML {
+			seen[a.Name.Local] = true
+		}
+	}
+
+	for p := n.Parent; p != nil; p = p.Parent {
+		for _, a := range p.Attributes {
+			if a.Name.Space == nsXML && !seen[a.Name.Local] {
+				seen[a.Name.Local] = true
+				list = append(list, a)
+			}
+		}
+	}
+	return list
+}
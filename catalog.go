@@ -0,0 +1,265 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+const nsCatalog = "urn:oasis:names:tc:entity:xmlns:xml:catalog"
+
+const (
+	catPublic = iota
+	catSystem
+	catRewriteSystem
+	catURI
+	catRewriteURI
+)
+
+// Catalog implements the OASIS XML Catalogs specification. It maps public
+// identifiers, system identifiers and uris of external resources to local
+// copies, so documents referring to remote DTDs and schemas can be processed
+// without network access.
+//
+// The public, system, rewriteSystem, uri, rewriteURI, group and nextCatalog
+// entries are supported.
+type Catalog struct {
+	entries []catalogEntry
+	next    []*Catalog
+}
+
+type catalogEntry struct {
+	kind   byte
+	match  string // Identifier, or prefix for the rewrite entries.
+	uri    string // Absolute target uri, or prefix for the rewrite entries.
+	public bool   // Whether prefer="public" is in effect for this entry.
+}
+
+// Load a catalog from the given catalog entry files. They are consulted in the
+// order given. Catalogs referenced through nextCatalog entries are loaded as
+// well; those which can not be loaded are silently ignored.
+func LoadCatalog(files ...string) (*Catalog, error) {
+	seen := make(map[string]bool)
+	c := new(Catalog)
+
+	for _, f := range files {
+		sub, err := loadCatalogFile(f, seen)
+		if err != nil {
+			return nil, err
+		}
+		c.next = append(c.next, sub)
+	}
+
+	return c, nil
+}
+
+func loadCatalogFile(uri string, seen map[string]bool) (*Catalog, error) {
+	seen[uri] = true
+
+	r, err := DefaultLoader(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	doc := New()
+	doc.BaseURI = uri
+	if err = doc.LoadStream(r, nil); err != nil {
+		return nil, err
+	}
+
+	c := new(Catalog)
+	for _, v := range doc.Root.SelectNodesDirect(nsCatalog, "catalog") {
+		c.addEntries(doc, v, v.As("", "prefer") != "system", seen)
+	}
+	return c, nil
+}
+
+func (this *Catalog) addEntries(doc *Document, n *Node, public bool, seen map[string]bool) {
+	for _, v := range n.Children {
+		if v.Type != NT_ELEMENT || v.Name.Space != nsCatalog {
+			continue
+		}
+
+		base := baseURI(doc, v)
+		switch v.Name.Local {
+		case "group":
+			pref := public
+			if p := v.As("", "prefer"); len(p) > 0 {
+				pref = p != "system"
+			}
+			this.addEntries(doc, v, pref, seen)
+
+		case "public":
+			pref := public
+			if p := v.As("", "prefer"); len(p) > 0 {
+				pref = p != "system"
+			}
+			this.entries = append(this.entries, catalogEntry{catPublic,
+				normalizePublicId(v.As("", "publicId")), resolveURI(base, v.As("", "uri")), pref})
+
+		case "system":
+			this.entries = append(this.entries, catalogEntry{catSystem,
+				v.As("", "systemId"), resolveURI(base, v.As("", "uri")), false})
+
+		case "rewriteSystem":
+			this.entries = append(this.entries, catalogEntry{catRewriteSystem,
+				v.As("", "systemIdStartString"), resolveURI(base, v.As("", "rewritePrefix")), false})
+
+		case "uri":
+			this.entries = append(this.entries, catalogEntry{catURI,
+				v.As("", "name"), resolveURI(base, v.As("", "uri")), false})
+
+		case "rewriteURI":
+			this.entries = append(this.entries, catalogEntry{catRewriteURI,
+				v.As("", "uriStartString"), resolveURI(base, v.As("", "rewritePrefix")), false})
+
+		case "nextCatalog":
+			uri := resolveURI(base, v.As("", "catalog"))
+			if seen[uri] {
+				continue
+			}
+			if sub, err := loadCatalogFile(uri, seen); err == nil {
+				this.next = append(this.next, sub)
+			}
+		}
+	}
+}
+
+// Returns the uri of the local copy for the external identifier made up of the
+// given public and system identifiers. Either of them may be empty. Returns an
+// empty string if the catalog holds no mapping for the identifier.
+func (this *Catalog) ResolveEntity(publicId, systemId string) string {
+	return this.resolveEntity(normalizePublicId(publicId), systemId)
+}
+
+func (this *Catalog) resolveEntity(publicId, systemId string) string {
+	if len(systemId) > 0 {
+		for _, e := range this.entries {
+			if e.kind == catSystem && e.match == systemId {
+				return e.uri
+			}
+		}
+
+		if uri := this.rewrite(catRewriteSystem, systemId); len(uri) > 0 {
+			return uri
+		}
+	}
+
+	if len(publicId) > 0 {
+		for _, e := range this.entries {
+			if e.kind == catPublic && e.match == publicId && (e.public || len(systemId) == 0) {
+				return e.uri
+			}
+		}
+	}
+
+	for _, c := range this.next {
+		if uri := c.resolveEntity(publicId, systemId); len(uri) > 0 {
+			return uri
+		}
+	}
+	return ""
+}
+
+// Returns the uri of the local copy for the given uri, or an empty string if
+// the catalog holds no mapping for it. This is meant for resources which are
+// not referenced through an external identifier, like XInclude targets or
+// schema locations.
+func (this *Catalog) ResolveURI(uri string) string {
+	for _, e := range this.entries {
+		if e.kind == catURI && e.match == uri {
+			return e.uri
+		}
+	}
+
+	if res := this.rewrite(catRewriteURI, uri); len(res) > 0 {
+		return res
+	}
+
+	for _, c := range this.next {
+		if res := c.ResolveURI(uri); len(res) > 0 {
+			return res
+		}
+	}
+	return ""
+}
+
+// rewrite applies the rewrite entry of the given kind with the longest
+// matching prefix.
+func (this *Catalog) rewrite(kind byte, id string) string {
+	var best *catalogEntry
+	for i, e := range this.entries {
+		if e.kind != kind || !strings.HasPrefix(id, e.match) {
+			continue
+		}
+		if best == nil || len(e.match) > len(best.match) {
+			best = &this.entries[i]
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return best.uri + id[len(best.match):]
+}
+
+// resolve looks up a plain uri, which is tried both as a uri and as a system
+// identifier.
+func (this *Catalog) resolve(uri string) string {
+	if res := this.ResolveURI(uri); len(res) > 0 {
+		return res
+	}
+	return this.ResolveEntity("", uri)
+}
+
+// Returns a Loader which maps uris through this catalog before passing them
+// on to next. If next is nil, DefaultLoader is used.
+func (this *Catalog) Loader(next Loader) Loader {
+	if next == nil {
+		next = DefaultLoader
+	}
+
+	return func(uri string) (io.ReadCloser, error) {
+		if res := this.resolve(uri); len(res) > 0 {
+			return next(res)
+		}
+		return next(uri)
+	}
+}
+
+// openEntity opens the external entity with the given identifiers. The system
+// identifier is resolved against base. Entities are only loaded if they are
+// mapped by the catalog, or if they refer to a local file; remote resources
+// are never fetched. Returns os.ErrNotExist if neither applies.
+func (this *Catalog) openEntity(publicId, systemId, base string) (io.ReadCloser, string, error) {
+	abs := resolveURI(base, systemId)
+
+	uri := this.ResolveEntity(publicId, systemId)
+	if len(uri) == 0 && abs != systemId {
+		uri = this.ResolveEntity("", abs)
+	}
+
+	if len(uri) == 0 {
+		if len(systemId) == 0 || isURL(abs) || len(base) == 0 || isURL(base) {
+			return nil, "", os.ErrNotExist
+		}
+		uri = abs
+	}
+
+	r, err := DefaultLoader(uri)
+	if err != nil {
+		return nil, uri, err
+	}
+	return r, uri, nil
+}
+
+// normalizePublicId collapses all whitespace in a public identifier.
+func normalizePublicId(id string) string {
+	return strings.Join(strings.Fields(id), " ")
+}
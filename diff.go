@@ -0,0 +1,677 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of changes reported by Diff.
+const (
+	CH_INSERT = iota
+	CH_DELETE
+	CH_UPDATE
+	CH_MOVE
+)
+
+// Maximum size of the table used to align two lists of child nodes. Longer
+// lists are aligned greedily.
+const diffMaxTable = 1 << 22
+
+// DiffOptions controls which differences Diff reports.
+type DiffOptions struct {
+	IgnoreWhitespace bool // Skip whitespace-only text and compare text without surrounding whitespace.
+	IgnoreComments   bool // Skip comments.
+	IgnoreAttrOrder  bool // Do not report attributes which only changed position.
+	IgnorePrefixes   bool // Compare names by namespace uri only, and skip namespace declarations.
+}
+
+// Change describes a single difference found by Diff.
+//
+// Paths are XPath expressions. Elements, text, comments and processing
+// instructions are selected by name or node test, with a position only if
+// there are several matching siblings. (eg: /a/b[2]/text(), /a/@id) Namespace
+// declarations are selected on the namespace axis.
+//
+// Changes are listed in an order in which they can be applied to the first
+// document to turn it into the second one. Each path refers to the document
+// with all preceding changes applied.
+type Change struct {
+	Type   byte   // One of the CH_* constants.
+	Path   string // Path of the changed node or attribute. For inserts and moves, its path after the change.
+	From   string // For moves of nodes, the path before the move.
+	Parent string // For inserts and moves of nodes, the path of the parent. Empty for the root of a document.
+	Before string // For inserts and moves, the path of the sibling placed before, or empty if appended.
+	Node   *Node  // The inserted, deleted, moved or updated node. Taken from the second document for inserts and updates.
+	Attr   *Attr  // The inserted, deleted, moved or updated attribute, if the change concerns one.
+	Old    string // Previous value, for updates and deletes of attributes.
+	New    string // New value, for updates and inserts of attributes.
+}
+
+// Compares the two nodes and their descendants, and returns the changes which
+// turn a into b. Both are usually documents roots, or elements. Child nodes
+// are aligned by content first; nodes which remain are paired by name,
+// compared recursively, or reported as inserted or deleted. Nodes which moved
+// within their parent are reported as such. Directives are not compared.
+func Diff(a, b *Node, opts DiffOptions) []Change {
+	d := &differ{opts: opts, hashes: make(map[*Node][sha256.Size]byte)}
+
+	switch {
+	case a.Type == NT_ROOT && b.Type == NT_ROOT:
+		d.children(a, b, "")
+	case d.matchable(a, b):
+		d.pair(a, b, nodePath(a))
+	default:
+		parent := ""
+		if a.Parent != nil {
+			parent = nodePath(a.Parent)
+		}
+		d.add(Change{Type: CH_DELETE, Path: nodePath(a), Node: a})
+		d.add(Change{Type: CH_INSERT, Path: nodePath(a), Parent: parent, Node: b})
+	}
+	return d.changes
+}
+
+type differ struct {
+	opts    DiffOptions
+	hashes  map[*Node][sha256.Size]byte
+	changes []Change
+}
+
+func (this *differ) add(c Change) {
+	this.changes = append(this.changes, c)
+}
+
+// pair compares two nodes which were matched to each other.
+func (this *differ) pair(x, y *Node, path string) {
+	if x.Type != NT_ELEMENT {
+		if this.value(x) != this.value(y) {
+			this.add(Change{Type: CH_UPDATE, Path: path, Node: y, Old: x.Value, New: y.Value})
+		}
+		return
+	}
+
+	this.attributes(x, y, path)
+	if this.value(x) != this.value(y) {
+		this.add(Change{Type: CH_UPDATE, Path: path, Node: y, Old: x.Value, New: y.Value})
+	}
+	this.children(x, y, path)
+}
+
+func (this *differ) attributes(x, y *Node, path string) {
+	ax, ay := this.attrs(x), this.attrs(y)
+
+	for _, a := range ax {
+		if findAttr(ay, a) == nil {
+			this.add(Change{Type: CH_DELETE, Path: attrPath(path, x, a), Attr: a, Old: a.Value})
+		}
+	}
+
+	for _, b := range ay {
+		a := findAttr(ax, b)
+		switch {
+		case a == nil:
+			this.add(Change{Type: CH_INSERT, Path: attrPath(path, y, b), Attr: b, New: b.Value})
+		case a.Value != b.Value:
+			this.add(Change{Type: CH_UPDATE, Path: attrPath(path, x, a), Attr: b, Old: a.Value, New: b.Value})
+		}
+	}
+
+	if this.opts.IgnoreAttrOrder {
+		return
+	}
+
+	// Attributes present in both, in their respective order.
+	var cx, cy []*Attr
+	for _, a := range ax {
+		if findAttr(ay, a) != nil {
+			cx = append(cx, a)
+		}
+	}
+	for _, b := range ay {
+		if findAttr(ax, b) != nil {
+			cy = append(cy, b)
+		}
+	}
+
+	kept := make(map[*Attr]bool)
+	for _, p := range lcs(len(cx), len(cy), func(i, j int) bool { return cx[i].Name == cy[j].Name }) {
+		kept[cy[p[1]]] = true
+	}
+
+	for i, b := range cy {
+		if kept[b] {
+			continue
+		}
+		c := Change{Type: CH_MOVE, Path: attrPath(path, y, b), Attr: b}
+		if i+1 < len(cy) {
+			c.Before = attrPath(path, y, cy[i+1])
+		}
+		this.add(c)
+	}
+}
+
+// attrs returns the attributes of n to be compared.
+func (this *differ) attrs(n *Node) []*Attr {
+	if !this.opts.IgnorePrefixes {
+		return n.Attributes
+	}
+
+	var list []*Attr
+	for _, a := range n.Attributes {
+		if !isNamespaceDecl(a) {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// children aligns and compares the child nodes of x and y.
+func (this *differ) children(x, y *Node, path string) {
+	w := &workList{all: append([]*Node(nil), x.Children...)}
+	w.sig = this.significant(w.all)
+	as, bs := append([]*Node(nil), w.sig...), this.significant(y.Children)
+
+	match := make(map[*Node]*Node) // Node in b to node in a.
+	equal := make(map[*Node]bool)  // Nodes in b matched to an equal node.
+
+	// Equal nodes in the same order anchor the alignment.
+	anchors := lcs(len(as), len(bs), func(i, j int) bool { return this.hash(as[i]) == this.hash(bs[j]) })
+	for _, p := range anchors {
+		match[bs[p[1]]] = as[p[0]]
+		equal[bs[p[1]]] = true
+	}
+
+	matched := make(map[*Node]bool)
+	for _, v := range match {
+		matched[v] = true
+	}
+
+	// Equal nodes left over on both sides were moved.
+	left := make(map[[sha256.Size]byte][]*Node)
+	for _, v := range as {
+		if !matched[v] {
+			h := this.hash(v)
+			left[h] = append(left[h], v)
+		}
+	}
+
+	for _, v := range bs {
+		if _, ok := match[v]; ok {
+			continue
+		}
+		h := this.hash(v)
+		if list := left[h]; len(list) > 0 {
+			match[v], equal[v] = list[0], true
+			matched[list[0]] = true
+			left[h] = list[1:]
+		}
+	}
+
+	// Remaining nodes are paired by name; between the same anchors first,
+	// then regardless of position.
+	anchors = append(anchors, [2]int{len(as), len(bs)})
+	pi, pj := 0, 0
+	for _, p := range anchors {
+		this.pairByName(as[pi:p[0]], bs[pj:p[1]], match, matched)
+		pi, pj = p[0]+1, p[1]+1
+	}
+	this.pairByName(as, bs, match, matched)
+
+	for _, v := range as {
+		if !matched[v] {
+			this.add(Change{Type: CH_DELETE, Path: w.path(path, v), Node: v})
+			w.remove(v)
+		}
+	}
+
+	// The longest run of matched nodes which kept their order stays in
+	// place; the others are moved.
+	index := make(map[*Node]int)
+	for i, v := range as {
+		index[v] = i
+	}
+	var order []int
+	for _, v := range bs {
+		if m, ok := match[v]; ok {
+			order = append(order, index[m])
+		}
+	}
+	stay := make(map[*Node]bool)
+	for _, i := range increasing(order) {
+		stay[as[i]] = true
+	}
+
+	// Build the new child list from left to right, placing each node right
+	// after the previous one. Nodes still to be moved may sit in between.
+	var prev *Node
+	for _, b := range bs {
+		var next *Node
+		if i := indexOf(w.sig, prev) + 1; i < len(w.sig) {
+			next = w.sig[i]
+		}
+
+		src, ok := match[b]
+		switch {
+		case !ok:
+			c := Change{Type: CH_INSERT, Parent: path, Node: b}
+			if next != nil {
+				c.Before = w.path(path, next)
+			}
+			w.insert(b, next)
+			c.Path = w.path(path, b)
+			this.add(c)
+			prev = b
+			continue
+
+		case !stay[src] && src != next:
+			c := Change{Type: CH_MOVE, From: w.path(path, src), Parent: path, Node: src}
+			w.remove(src)
+			if next != nil {
+				c.Before = w.path(path, next)
+			}
+			w.insert(src, next)
+			c.Path = w.path(path, src)
+			this.add(c)
+		}
+
+		if !equal[b] {
+			this.pair(src, b, w.path(path, src))
+		}
+		prev = src
+	}
+}
+
+// indexOf returns the position of n in list, or -1 if it is not there.
+func indexOf(list []*Node, n *Node) int {
+	for i, v := range list {
+		if v == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// increasing returns a longest strictly increasing subsequence of list.
+func increasing(list []int) []int {
+	var tails []int // Positions in list ending the best run of each length.
+	back := make([]int, len(list))
+
+	for i, v := range list {
+		k := sort.Search(len(tails), func(k int) bool { return list[tails[k]] >= v })
+		if k > 0 {
+			back[i] = tails[k-1]
+		} else {
+			back[i] = -1
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+
+	seq := make([]int, len(tails))
+	if len(tails) > 0 {
+		for k, i := len(tails)-1, tails[len(tails)-1]; k >= 0; k, i = k-1, back[i] {
+			seq[k] = list[i]
+		}
+	}
+	return seq
+}
+
+// pairByName pairs the unmatched nodes in as and bs which can be compared
+// with each other, keeping their order.
+func (this *differ) pairByName(as, bs []*Node, match map[*Node]*Node, matched map[*Node]bool) {
+	var ra, rb []*Node
+	for _, v := range as {
+		if !matched[v] {
+			ra = append(ra, v)
+		}
+	}
+	for _, v := range bs {
+		if _, ok := match[v]; !ok {
+			rb = append(rb, v)
+		}
+	}
+
+	for _, p := range lcs(len(ra), len(rb), func(i, j int) bool { return this.matchable(ra[i], rb[j]) }) {
+		match[rb[p[1]]] = ra[p[0]]
+		matched[ra[p[0]]] = true
+	}
+}
+
+// significant returns the nodes from list which are compared.
+func (this *differ) significant(list []*Node) []*Node {
+	var res []*Node
+	for _, v := range list {
+		switch {
+		case v.Type == NT_DIRECTIVE:
+		case v.Type == NT_COMMENT && this.opts.IgnoreComments:
+		case isWhitespace(v) && this.opts.IgnoreWhitespace:
+		default:
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// matchable returns true if x and y may be paired and compared.
+func (this *differ) matchable(x, y *Node) bool {
+	if x.Type != y.Type {
+		return false
+	}
+
+	switch x.Type {
+	case NT_ELEMENT:
+		if x.Name != y.Name {
+			return false
+		}
+		return this.opts.IgnorePrefixes || elementPrefix(x) == elementPrefix(y)
+	case NT_PROCINST:
+		return x.Target == y.Target
+	}
+	return true
+}
+
+func (this *differ) value(n *Node) string {
+	if this.opts.IgnoreWhitespace {
+		return strings.TrimSpace(n.Value)
+	}
+	return n.Value
+}
+
+// hash returns a digest of n and its descendants, covering everything which
+// is compared.
+func (this *differ) hash(n *Node) [sha256.Size]byte {
+	if h, ok := this.hashes[n]; ok {
+		return h
+	}
+
+	h := sha256.New()
+	write := func(s string) {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+
+	write(strconv.Itoa(int(n.Type)))
+	write(n.Name.Space)
+	write(n.Name.Local)
+	write(n.Target)
+	write(this.value(n))
+
+	if n.Type == NT_ELEMENT {
+		if !this.opts.IgnorePrefixes {
+			write(elementPrefix(n))
+		}
+
+		attrs := this.attrs(n)
+		if this.opts.IgnoreAttrOrder {
+			attrs = sortedAttrs(attrs)
+		}
+		for _, a := range attrs {
+			write(a.Name.Space)
+			write(a.Name.Local)
+			write(a.Value)
+		}
+	}
+
+	for _, v := range this.significant(n.Children) {
+		sum := this.hash(v)
+		h.Write(sum[:])
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	this.hashes[n] = sum
+	return sum
+}
+
+// workList holds the children of a node while changes are applied to them.
+type workList struct {
+	all []*Node // All children.
+	sig []*Node // Children which are compared.
+}
+
+func (this *workList) path(parent string, n *Node) string {
+	return parent + "/" + pathStep(n, this.all)
+}
+
+// insert adds n before the given node, or at the end if before is nil.
+func (this *workList) insert(n, before *Node) {
+	this.all = insertNode(this.all, n, before)
+	this.sig = insertNode(this.sig, n, before)
+}
+
+func (this *workList) remove(n *Node) {
+	this.all = removeNode(this.all, n)
+	this.sig = removeNode(this.sig, n)
+}
+
+func insertNode(list []*Node, n, before *Node) []*Node {
+	for i, v := range list {
+		if v == before {
+			list = append(list, nil)
+			copy(list[i+1:], list[i:])
+			list[i] = n
+			return list
+		}
+	}
+	return append(list, n)
+}
+
+func removeNode(list []*Node, n *Node) []*Node {
+	for i, v := range list {
+		if v == n {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func findAttr(list []*Attr, a *Attr) *Attr {
+	for _, v := range list {
+		if v.Name == a.Name {
+			return v
+		}
+	}
+	return nil
+}
+
+// lcs returns the index pairs of a longest common subsequence of two lists
+// with lengths n and m, as determined by eq.
+func lcs(n, m int, eq func(i, j int) bool) [][2]int {
+	var head, tail [][2]int
+
+	// Common prefix and suffix need no table.
+	for len(head) < n && len(head) < m && eq(len(head), len(head)) {
+		head = append(head, [2]int{len(head), len(head)})
+	}
+	lo := len(head)
+	for n > lo && m > lo && eq(n-1, m-1) {
+		n, m = n-1, m-1
+		tail = append([][2]int{{n, m}}, tail...)
+	}
+
+	rows, cols := n-lo, m-lo
+	if rows == 0 || cols == 0 {
+		return append(head, tail...)
+	}
+
+	if rows*cols > diffMaxTable {
+		j := lo
+		for i := lo; i < n; i++ {
+			for k := j; k < m && k < j+64; k++ {
+				if eq(i, k) {
+					head = append(head, [2]int{i, k})
+					j = k + 1
+					break
+				}
+			}
+		}
+		return append(head, tail...)
+	}
+
+	// table[i][j] holds the length of the lcs of the lists from i and j on.
+	table := make([]int32, (rows+1)*(cols+1))
+	at := func(i, j int) *int32 { return &table[i*(cols+1)+j] }
+	for i := rows - 1; i >= 0; i-- {
+		for j := cols - 1; j >= 0; j-- {
+			switch {
+			case eq(lo+i, lo+j):
+				*at(i, j) = *at(i+1, j+1) + 1
+			case *at(i+1, j) >= *at(i, j+1):
+				*at(i, j) = *at(i+1, j)
+			default:
+				*at(i, j) = *at(i, j+1)
+			}
+		}
+	}
+
+	for i, j := 0, 0; i < rows && j < cols; {
+		switch {
+		case eq(lo+i, lo+j):
+			head = append(head, [2]int{lo + i, lo + j})
+			i, j = i+1, j+1
+		case *at(i+1, j) >= *at(i, j+1):
+			i++
+		default:
+			j++
+		}
+	}
+	return append(head, tail...)
+}
+
+// nodePath returns the path of n in its tree.
+func nodePath(n *Node) string {
+	switch {
+	case n.Type == NT_ROOT:
+		return ""
+	case n.Parent == nil:
+		return "/" + pathStep(n, nil)
+	}
+	return nodePath(n.Parent) + "/" + pathStep(n, n.Parent.Children)
+}
+
+// pathStep returns the location step selecting n among the given siblings.
+func pathStep(n *Node, siblings []*Node) string {
+	var test string
+	switch n.Type {
+	case NT_ELEMENT:
+		test = qualifiedName(elementPrefix(n), n.Name.Local)
+	case NT_TEXT:
+		test = "text()"
+	case NT_COMMENT:
+		test = "comment()"
+	case NT_PROCINST:
+		test = "processing-instruction('" + n.Target + "')"
+	default:
+		test = "node()"
+	}
+
+	pos, count := 0, 0
+	for _, v := range siblings {
+		if v.Type != n.Type || v.Type == NT_ELEMENT && v.Name != n.Name || v.Type == NT_PROCINST && v.Target != n.Target {
+			continue
+		}
+		count++
+		if v == n {
+			pos = count
+		}
+	}
+
+	if count > 1 {
+		return fmt.Sprintf("%s[%d]", test, pos)
+	}
+	return test
+}
+
+// attrPath returns the path of attribute a of element n, at the given path.
+func attrPath(path string, n *Node, a *Attr) string {
+	switch {
+	case a.Name.Space == "xmlns":
+		return path + "/namespace::" + a.Name.Local
+	case isNamespaceDecl(a):
+		return path + "/namespace::*[name()='']"
+	case len(a.Name.Space) > 0:
+		return path + "/@" + qualifiedName(n.spacePrefix(a.Name.Space), a.Name.Local)
+	}
+	return path + "/@" + a.Name.Local
+}
+
+func qualifiedName(prefix, local string) string {
+	if len(prefix) > 0 {
+		return prefix + ":" + local
+	}
+	return local
+}
+
+// Returns a single line describing the change.
+func (this Change) String() string {
+	switch this.Type {
+	case CH_INSERT:
+		if this.Attr != nil {
+			return fmt.Sprintf("+ %s = %s", this.Path, strconv.Quote(this.New))
+		}
+		return fmt.Sprintf("+ %s %s", this.Path, summarize(this.Node))
+
+	case CH_DELETE:
+		if this.Attr != nil {
+			return fmt.Sprintf("- %s = %s", this.Path, strconv.Quote(this.Old))
+		}
+		return fmt.Sprintf("- %s %s", this.Path, summarize(this.Node))
+
+	case CH_UPDATE:
+		return fmt.Sprintf("~ %s %s -> %s", this.Path, strconv.Quote(this.Old), strconv.Quote(this.New))
+
+	case CH_MOVE:
+		if this.Attr != nil {
+			if len(this.Before) == 0 {
+				return fmt.Sprintf("> %s to the end", this.Path)
+			}
+			return fmt.Sprintf("> %s before %s", this.Path, this.Before)
+		}
+		return fmt.Sprintf("> %s -> %s", this.From, this.Path)
+	}
+	return fmt.Sprintf("? %s", this.Path)
+}
+
+// summarize returns a short, single line representation of n.
+func summarize(n *Node) string {
+	var s string
+	switch n.Type {
+	case NT_TEXT:
+		s = strconv.Quote(n.Value)
+	default:
+		s = strings.Join(strings.Fields(n.String()), " ")
+	}
+
+	if len(s) > 60 {
+		// Cut at a rune boundary.
+		i := 57
+		for i > 0 && s[i]&0xC0 == 0x80 {
+			i--
+		}
+		s = s[:i] + "..."
+	}
+	return s
+}
+
+// Write a human readable report of the given changes to w, one line per
+// change. Inserts are marked with '+', deletes with '-', updates with '~' and
+// moves with '>'.
+func WriteReport(w io.Writer, changes []Change) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range changes {
+		bw.WriteString(c.String())
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
@@ -33,9 +33,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -43,16 +44,32 @@ import (
 // Used to tell the xml decoder how to deal with non-utf8 characters.
 type CharsetFunc func(charset string, input io.Reader) (io.Reader, error)
 
+// This signature represents a routine which opens the resource identified by
+// the given uri. It is used to fetch external resources referenced from a
+// document, like XInclude targets.
+type Loader func(uri string) (io.ReadCloser, error)
+
 // represents a single XML document.
 type Document struct {
-	Version     string            // XML version
-	Encoding    string            // Encoding found in document. If absent, assumes UTF-8.
-	StandAlone  string            // Value of XML doctype's 'standalone' attribute.
-	Entity      map[string]string // Mapping of custom entity conversions.
-	Root        *Node             // The document's root node.
-	SaveDocType bool              // Whether not to include the XML doctype in saves.
-
-	useragent string // Used internally
+	Version           string            // XML version
+	Encoding          string            // Encoding found in document. If absent, assumes UTF-8. Also used for saving.
+	StandAlone        string            // Value of XML doctype's 'standalone' attribute.
+	Entity            map[string]string // Mapping of custom entity conversions.
+	Root              *Node             // The document's root node.
+	SaveDocType       bool              // Whether not to include the XML doctype in saves.
+	BaseURI           string            // Location the document was loaded from.
+	Catalog           *Catalog          // Used to resolve external identifiers to local resources.
+	PreferredPrefixes map[string]string // Prefixes to declare on save for namespaces without one in scope, by uri.
+	InternalEntities  bool              // Whether to load the entities declared in the DOCTYPE's internal subset.
+
+	useragent string             // Used internally
+	tx        *Tx                // Innermost open transaction.
+	history   bool               // Set once changes are recorded for Undo.
+	undo      [][]MutationRecord // Committed changes, most recent last.
+	redo      [][]MutationRecord // Undone changes, most recent last.
+	replaying bool               // Set while changes are undone or redone.
+	observers []*observer        // Functions registered with Observe.
+	tracked   bool               // Set once Root.owner was set by Begin or Observe.
 }
 
 // Create a new, empty XML document instance.
@@ -101,13 +118,28 @@ func (this *Document) SelectNodesRecursive(namespace, name string) []*Node {
 }
 
 // Load the contents of this document from the supplied reader.
+//
+// Entities declared in the internal subset of the document's DOCTYPE are
+// added to the Entity map if InternalEntities is set. Their expanded values
+// are limited in size and nesting, so a hostile DTD can not make them grow
+// out of bounds. If the document has a Catalog, the entity
+// declarations of the external DTD are loaded too, provided the catalog maps
+// it to a local resource.
 func (this *Document) LoadStream(r io.Reader, charset CharsetFunc) (err error) {
+	if this.Entity == nil {
+		this.Entity = make(map[string]string)
+	}
+
 	xp := xml.NewDecoder(r)
 	xp.Entity = this.Entity
 	xp.CharsetReader = charset
 
-	this.Root = NewNode(NT_ROOT)
-	ct := this.Root
+	// The content is built apart, and moved into the document when done. Its
+	// nodes are added without recording changes, since there are none to
+	// report yet.
+	root := NewNode(NT_ROOT)
+	defer this.setRoot(root)
+	ct := root
 
 	var tok xml.Token
 	var t *Node
@@ -127,15 +159,20 @@ func (this *Document) LoadStream(r io.Reader, charset CharsetFunc) (err error) {
 		case xml.CharData:
 			t := NewNode(NT_TEXT)
 			t.Value = string([]byte(tt))
-			ct.AddChild(t)
+			ct.insertChild(len(ct.Children), t)
 		case xml.Comment:
 			t := NewNode(NT_COMMENT)
 			t.Value = strings.TrimSpace(string([]byte(tt)))
-			ct.AddChild(t)
+			ct.insertChild(len(ct.Children), t)
 		case xml.Directive:
 			t = NewNode(NT_DIRECTIVE)
 			t.Value = strings.TrimSpace(string([]byte(tt)))
-			ct.AddChild(t)
+			ct.insertChild(len(ct.Children), t)
+			if strings.HasPrefix(t.Value, "DOCTYPE") {
+				if err = this.loadDocType(t.Value); err != nil {
+					return
+				}
+			}
 		case xml.StartElement:
 			t = NewNode(NT_ELEMENT)
 			t.Name = tt.Name
@@ -145,7 +182,7 @@ func (this *Document) LoadStream(r io.Reader, charset CharsetFunc) (err error) {
 				t.Attributes[i].Name = v.Name
 				t.Attributes[i].Value = v.Value
 			}
-			ct.AddChild(t)
+			ct.insertChild(len(ct.Children), t)
 			ct = t
 		case xml.ProcInst:
 			if tt.Target == "xml" { // xml doctype
@@ -159,7 +196,7 @@ func (this *Document) LoadStream(r io.Reader, charset CharsetFunc) (err error) {
 				t = NewNode(NT_PROCINST)
 				t.Target = strings.TrimSpace(tt.Target)
 				t.Value = strings.TrimSpace(string(tt.Inst))
-				ct.AddChild(t)
+				ct.insertChild(len(ct.Children), t)
 			}
 		case xml.EndElement:
 			if ct = ct.Parent; ct == nil {
@@ -167,8 +204,6 @@ func (this *Document) LoadStream(r io.Reader, charset CharsetFunc) (err error) {
 			}
 		}
 	}
-
-	return
 }
 
 // Load the contents of this document from the supplied byte slice.
@@ -189,14 +224,31 @@ func (this *Document) LoadFile(filename string, charset CharsetFunc) (err error)
 	}
 
 	defer fd.Close()
+	this.BaseURI = filename
 	return this.LoadStream(fd, charset)
 }
 
 // Load the contents of this document from the supplied uri using the specifed
 // client.
+//
+// If the document has a Catalog which maps the uri to a local resource, that
+// resource is loaded instead.
 func (this *Document) LoadUriClient(uri string, client *http.Client, charset CharsetFunc) (err error) {
 	var r *http.Response
 
+	if this.Catalog != nil {
+		if local := this.Catalog.resolve(uri); len(local) > 0 {
+			var rc io.ReadCloser
+			if rc, err = DefaultLoader(local); err != nil {
+				return
+			}
+
+			defer rc.Close()
+			this.BaseURI = local
+			return this.LoadStream(rc, charset)
+		}
+	}
+
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return
@@ -210,6 +262,7 @@ func (this *Document) LoadUriClient(uri string, client *http.Client, charset Cha
 	}
 
 	defer r.Body.Close()
+	this.BaseURI = uri
 	return this.LoadStream(r.Body, charset)
 }
 
@@ -221,37 +274,117 @@ func (this *Document) LoadUri(uri string, charset CharsetFunc) (err error) {
 
 // Save the contents of this document to the supplied file.
 func (this *Document) SaveFile(path string) error {
-	return ioutil.WriteFile(path, this.SaveBytes(), 0600)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err = this.SaveStream(fd); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
 }
 
-// Save the contents of this document as a byte slice.
+// Save the contents of this document as a byte slice. Returns nil if the
+// document can not be written; use SaveStream or SaveBytesWith to find out
+// why.
 func (this *Document) SaveBytes() []byte {
 	var b bytes.Buffer
-
-	if this.SaveDocType {
-		b.WriteString(fmt.Sprintf(`<?xml version="%s" encoding="%s" standalone="%s"?>`,
-			this.Version, this.Encoding, this.StandAlone))
-
-		if len(IndentPrefix) > 0 {
-			b.WriteByte('\n')
-		}
+	if err := this.SaveStream(&b); err != nil {
+		return nil
 	}
-
-	b.Write(this.Root.Bytes())
 	return b.Bytes()
 }
 
-// Save the contents of this document as a string.
+// Save the contents of this document as a string. Returns an empty string if
+// the document can not be written. See Document.SaveBytes.
 func (this *Document) SaveString() string { return string(this.SaveBytes()) }
 
 // Alias for Document.SaveString(). This one is invoked by anything looking for
 // the standard String() method (eg: fmt.Printf("%s\n", mydoc).
 func (this *Document) String() string { return string(this.SaveBytes()) }
 
-// Save the contents of this document to the supplied writer.
-func (this *Document) SaveStream(w io.Writer) (err error) {
-	_, err = w.Write(this.SaveBytes())
-	return
+// Save the contents of this document to the supplied writer. The document is
+// written incrementally, without building it in memory first. It is encoded
+// as described for Document.SaveWith.
+func (this *Document) SaveStream(w io.Writer) error {
+	return this.save(w, SaveOptions{}, len(IndentPrefix) > 0)
+}
+
+// Opens the resource at the given uri. Http(s) and file uris are supported;
+// anything else is treated as a local file path.
+func DefaultLoader(uri string) (io.ReadCloser, error) {
+	if u, err := url.Parse(uri); err == nil {
+		switch u.Scheme {
+		case "http", "https":
+			r, err := http.Get(uri)
+			if err != nil {
+				return nil, err
+			}
+			if r.StatusCode != http.StatusOK {
+				r.Body.Close()
+				return nil, fmt.Errorf("xmlx: fetching %s: %s", uri, r.Status)
+			}
+			return r.Body, nil
+		case "file":
+			uri = filepath.FromSlash(u.Path)
+		}
+	}
+
+	fd, err := os.Open(uri)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// resolveURI resolves ref against base. Both may either be uris or local file
+// paths.
+func resolveURI(base, ref string) string {
+	if isURL(ref) || len(base) == 0 {
+		return ref
+	}
+
+	if isURL(base) {
+		b, err := url.Parse(base)
+		if err != nil {
+			return ref
+		}
+		r, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return b.ResolveReference(r).String()
+	}
+
+	ref = filepath.FromSlash(ref)
+	if filepath.IsAbs(ref) {
+		return ref
+	}
+
+	dir := base
+	if !isDir(base) {
+		dir = filepath.Dir(base)
+	}
+
+	// Keep a trailing separator, so the result can serve as a base itself.
+	res := filepath.Join(dir, ref)
+	if isDir(ref) {
+		res += string(filepath.Separator)
+	}
+	return res
+}
+
+func isDir(path string) bool {
+	return strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator))
+}
+
+// isURL returns true if s starts with a uri scheme. Single letter schemes are
+// ignored, so Windows drive letters are not mistaken for one.
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && len(u.Scheme) > 1
 }
 
 // Set a custom user agent when making a new request.
@@ -0,0 +1,533 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+// Package dsig implements enveloped XML Signatures (XMLDSig) over xmlx
+// documents. Signatures use RSA-SHA256 or ECDSA-SHA256, SHA-256 reference
+// digests and exclusive canonicalization. References address the whole
+// document or elements carrying an Id, ID or id attribute.
+package dsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/mattn/go-pkg-xmlx"
+)
+
+// Namespace and algorithm identifiers.
+const (
+	NS                = "http://www.w3.org/2000/09/xmldsig#"
+	RSA_SHA256        = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	ECDSA_SHA256      = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	SHA256            = "http://www.w3.org/2001/04/xmlenc#sha256"
+	ENVELOPED         = NS + "enveloped-signature"
+	C14N              = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	C14N_COMMENTS     = C14N + "#WithComments"
+	EXC_C14N          = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	EXC_C14N_COMMENTS = EXC_C14N + "WithComments"
+)
+
+// Key holds the signing key and the certificates embedded in the signature.
+type Key struct {
+	Signer       crypto.Signer       // An RSA or ECDSA private key.
+	Certificates []*x509.Certificate // Signing certificate first, followed by intermediates.
+}
+
+// Sign the given document. Each entry of refs is the Id of an element to be
+// signed; an empty string signs the whole document. If refs is empty, the
+// whole document is signed.
+//
+// The ds:Signature element is appended to the document element and returned.
+// Every reference carries the enveloped-signature transform, so it may be
+// moved anywhere in the document, eg: after the saml:Issuer of an assertion.
+// Note that the document should not be pretty printed after signing, since
+// that changes the signed content.
+func Sign(doc *xmlx.Document, key *Key, refs []string) (*xmlx.Node, error) {
+	if key == nil || key.Signer == nil {
+		return nil, errors.New("dsig: no signing key")
+	}
+
+	method, err := signatureMethod(key.Signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	root := documentElement(doc)
+	if root == nil {
+		return nil, errors.New("dsig: document has no root element")
+	}
+
+	ids, err := collectIds(doc.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(refs) == 0 {
+		refs = []string{""}
+	}
+
+	// Digests are computed before the signature is added, which has the
+	// same effect as the enveloped-signature transform.
+	digests := make([][]byte, len(refs))
+	for i, id := range refs {
+		target := doc.Root
+		if len(id) > 0 {
+			if target = ids[id]; target == nil {
+				return nil, fmt.Errorf("dsig: no element with Id %q", id)
+			}
+		}
+
+		if digests[i], err = digest(target, xmlx.C14N_EXCLUSIVE, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	sig := xmlx.NewNode(xmlx.NT_ELEMENT)
+	sig.Name = xml.Name{Space: NS, Local: "Signature"}
+	sig.Attributes = append(sig.Attributes, &xmlx.Attr{Name: xml.Name{Space: "xmlns", Local: "ds"}, Value: NS})
+	root.AddChild(sig)
+
+	si := element(sig, "SignedInfo")
+	element(si, "CanonicalizationMethod").SetAttr("Algorithm", EXC_C14N)
+	element(si, "SignatureMethod").SetAttr("Algorithm", method)
+
+	for i, id := range refs {
+		ref := element(si, "Reference")
+		if len(id) > 0 {
+			ref.SetAttr("URI", "#"+id)
+		} else {
+			ref.SetAttr("URI", "")
+		}
+
+		transforms := element(ref, "Transforms")
+		element(transforms, "Transform").SetAttr("Algorithm", ENVELOPED)
+		element(transforms, "Transform").SetAttr("Algorithm", EXC_C14N)
+		element(ref, "DigestMethod").SetAttr("Algorithm", SHA256)
+		element(ref, "DigestValue").SetValue(base64.StdEncoding.EncodeToString(digests[i]))
+	}
+
+	value, err := signSignedInfo(si, key.Signer)
+	if err != nil {
+		root.RemoveChild(sig)
+		return nil, err
+	}
+
+	element(sig, "SignatureValue").SetValue(base64.StdEncoding.EncodeToString(value))
+
+	if len(key.Certificates) > 0 {
+		data := element(element(sig, "KeyInfo"), "X509Data")
+		for _, c := range key.Certificates {
+			element(data, "X509Certificate").SetValue(base64.StdEncoding.EncodeToString(c.Raw))
+		}
+	}
+
+	return sig, nil
+}
+
+// Verify all signatures in the given document. The signing certificate is
+// taken from the KeyInfo of each signature and must chain up to one of the
+// given roots. If roots is nil, the system roots are used.
+//
+// Returns the nodes covered by the signatures: the document root for
+// references to the whole document, the referenced elements otherwise.
+// Callers should only trust the content of these nodes. An error is returned
+// if the document holds no signature, or if any of them fails to verify.
+func Verify(doc *xmlx.Document, roots *x509.CertPool) ([]*xmlx.Node, error) {
+	sigs := doc.Root.SelectNodesRecursive(NS, "Signature")
+	if len(sigs) == 0 {
+		return nil, errors.New("dsig: document is not signed")
+	}
+
+	ids, err := collectIds(doc.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed []*xmlx.Node
+	for _, sig := range sigs {
+		list, err := verifySignature(doc, sig, ids, roots)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, list...)
+	}
+	return signed, nil
+}
+
+func verifySignature(doc *xmlx.Document, sig *xmlx.Node, ids map[string]*xmlx.Node, roots *x509.CertPool) ([]*xmlx.Node, error) {
+	si := child(sig, "SignedInfo")
+	if si == nil {
+		return nil, errors.New("dsig: signature has no SignedInfo")
+	}
+
+	cm := child(si, "CanonicalizationMethod")
+	if cm == nil {
+		return nil, errors.New("dsig: SignedInfo has no CanonicalizationMethod")
+	}
+
+	mode, err := canonicalizationMode(cm.As("", "Algorithm"))
+	if err != nil {
+		return nil, err
+	}
+
+	sm := child(si, "SignatureMethod")
+	if sm == nil {
+		return nil, errors.New("dsig: SignedInfo has no SignatureMethod")
+	}
+
+	sv := child(sig, "SignatureValue")
+	if sv == nil {
+		return nil, errors.New("dsig: signature has no SignatureValue")
+	}
+
+	value, err := decodeBase64(sv.GetValue())
+	if err != nil {
+		return nil, fmt.Errorf("dsig: invalid SignatureValue: %v", err)
+	}
+
+	cert, err := certificate(sig, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err = si.Canonicalize(&b, mode, inclusivePrefixes(cm)...); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(b.Bytes())
+	if err = verifyValue(sm.As("", "Algorithm"), cert.PublicKey, hash[:], value); err != nil {
+		return nil, err
+	}
+
+	// The signature is valid, now check the references it covers.
+	refs := si.SelectNodesDirect(NS, "Reference")
+	if len(refs) == 0 {
+		return nil, errors.New("dsig: SignedInfo has no Reference")
+	}
+
+	var signed []*xmlx.Node
+	for _, ref := range refs {
+		target, err := verifyReference(doc, sig, ref, ids)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, target)
+	}
+	return signed, nil
+}
+
+func verifyReference(doc *xmlx.Document, sig, ref *xmlx.Node, ids map[string]*xmlx.Node) (*xmlx.Node, error) {
+	uri := ref.As("", "URI")
+
+	var target *xmlx.Node
+	switch {
+	case len(uri) == 0:
+		target = doc.Root
+	case strings.HasPrefix(uri, "#") && !strings.HasPrefix(uri, "#xpointer("):
+		if target = ids[uri[1:]]; target == nil {
+			return nil, fmt.Errorf("dsig: reference %q not found", uri)
+		}
+	default:
+		return nil, fmt.Errorf("dsig: unsupported reference %q", uri)
+	}
+
+	// Without a canonicalization transform, the node-set is converted to
+	// octets with Canonical XML 1.0.
+	var mode byte = xmlx.C14N_10
+	var prefixes []string
+	enveloped := false
+
+	if transforms := child(ref, "Transforms"); transforms != nil {
+		for _, t := range transforms.SelectNodesDirect(NS, "Transform") {
+			alg := t.As("", "Algorithm")
+			if alg == ENVELOPED {
+				enveloped = true
+				continue
+			}
+
+			m, err := canonicalizationMode(alg)
+			if err != nil {
+				return nil, err
+			}
+			mode, prefixes = m, inclusivePrefixes(t)
+		}
+	}
+
+	// Same document references never include comments.
+	switch mode {
+	case xmlx.C14N_10_COMMENTS:
+		mode = xmlx.C14N_10
+	case xmlx.C14N_EXCLUSIVE_COMMENTS:
+		mode = xmlx.C14N_EXCLUSIVE
+	}
+
+	dm := child(ref, "DigestMethod")
+	if dm == nil || dm.As("", "Algorithm") != SHA256 {
+		return nil, fmt.Errorf("dsig: unsupported digest method for reference %q", uri)
+	}
+
+	dv := child(ref, "DigestValue")
+	if dv == nil {
+		return nil, fmt.Errorf("dsig: reference %q has no DigestValue", uri)
+	}
+
+	expect, err := decodeBase64(dv.GetValue())
+	if err != nil {
+		return nil, fmt.Errorf("dsig: invalid DigestValue for reference %q: %v", uri, err)
+	}
+
+	if enveloped {
+		defer detach(sig)()
+	}
+
+	sum, err := digest(target, mode, prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(sum, expect) {
+		return nil, fmt.Errorf("dsig: digest mismatch for reference %q", uri)
+	}
+	return target, nil
+}
+
+// certificate returns the signing certificate from the KeyInfo of sig, after
+// verifying it against roots. Further certificates are used as intermediates.
+func certificate(sig *xmlx.Node, roots *x509.CertPool) (*x509.Certificate, error) {
+	ki := child(sig, "KeyInfo")
+	if ki == nil {
+		return nil, errors.New("dsig: signature has no KeyInfo")
+	}
+
+	var certs []*x509.Certificate
+	for _, v := range ki.SelectNodes(NS, "X509Certificate") {
+		data, err := decodeBase64(v.GetValue())
+		if err != nil {
+			return nil, fmt.Errorf("dsig: invalid X509Certificate: %v", err)
+		}
+
+		c, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("dsig: signature has no X509Certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+func signatureMethod(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return RSA_SHA256, nil
+	case *ecdsa.PublicKey:
+		return ECDSA_SHA256, nil
+	}
+	return "", fmt.Errorf("dsig: unsupported key type %T", pub)
+}
+
+// signSignedInfo returns the signature value over the canonical form of si.
+func signSignedInfo(si *xmlx.Node, signer crypto.Signer) ([]byte, error) {
+	var b bytes.Buffer
+	if err := si.Canonicalize(&b, xmlx.C14N_EXCLUSIVE); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(b.Bytes())
+	value, err := signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return value, nil
+	}
+
+	// XMLDSig uses the concatenation of r and s, rather than ASN.1.
+	var rs struct{ R, S *big.Int }
+	if _, err = asn1.Unmarshal(value, &rs); err != nil {
+		return nil, err
+	}
+
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	value = make([]byte, 2*size)
+	rs.R.FillBytes(value[:size])
+	rs.S.FillBytes(value[size:])
+	return value, nil
+}
+
+func verifyValue(method string, pub crypto.PublicKey, hash, value []byte) error {
+	switch method {
+	case RSA_SHA256:
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("dsig: certificate does not hold an RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, value); err != nil {
+			return errors.New("dsig: invalid signature")
+		}
+		return nil
+
+	case ECDSA_SHA256:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("dsig: certificate does not hold an ECDSA key")
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(value) != 2*size {
+			return errors.New("dsig: invalid signature")
+		}
+		r := new(big.Int).SetBytes(value[:size])
+		s := new(big.Int).SetBytes(value[size:])
+		if !ecdsa.Verify(key, hash, r, s) {
+			return errors.New("dsig: invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("dsig: unsupported signature method %q", method)
+}
+
+func canonicalizationMode(alg string) (byte, error) {
+	switch alg {
+	case C14N:
+		return xmlx.C14N_10, nil
+	case C14N_COMMENTS:
+		return xmlx.C14N_10_COMMENTS, nil
+	case EXC_C14N:
+		return xmlx.C14N_EXCLUSIVE, nil
+	case EXC_C14N_COMMENTS:
+		return xmlx.C14N_EXCLUSIVE_COMMENTS, nil
+	}
+	return 0, fmt.Errorf("dsig: unsupported algorithm %q", alg)
+}
+
+// inclusivePrefixes returns the PrefixList of the InclusiveNamespaces element
+// in the given method or transform, if any.
+func inclusivePrefixes(n *xmlx.Node) []string {
+	for _, v := range n.SelectNodesDirect(EXC_C14N, "InclusiveNamespaces") {
+		return strings.Fields(v.As("", "PrefixList"))
+	}
+	return nil
+}
+
+// digest returns the SHA-256 digest of the canonical form of n.
+func digest(n *xmlx.Node, mode byte, prefixes []string) ([]byte, error) {
+	h := sha256.New()
+	if err := n.Canonicalize(h, mode, prefixes...); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// collectIds maps the values of Id, ID and id attributes to their elements.
+// Duplicate values are rejected, since they make references ambiguous.
+func collectIds(n *xmlx.Node) (map[string]*xmlx.Node, error) {
+	ids := make(map[string]*xmlx.Node)
+
+	var walk func(n *xmlx.Node) error
+	walk = func(n *xmlx.Node) error {
+		for _, a := range n.Attributes {
+			if len(a.Name.Space) > 0 {
+				continue
+			}
+			switch a.Name.Local {
+			case "Id", "ID", "id":
+				if _, ok := ids[a.Value]; ok {
+					return fmt.Errorf("dsig: duplicate Id %q", a.Value)
+				}
+				ids[a.Value] = n
+			}
+		}
+
+		for _, v := range n.Children {
+			if err := walk(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(n); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// detach temporarily removes n from the tree. Returns a function which puts
+// it back in its original place.
+func detach(n *xmlx.Node) func() {
+	p := n.Parent
+	i := 0
+	for p.Children[i] != n {
+		i++
+	}
+
+	n.Detach()
+	return func() { p.InsertAt(i, n) }
+}
+
+func documentElement(doc *xmlx.Document) *xmlx.Node {
+	if doc.Root == nil {
+		return nil
+	}
+	for _, v := range doc.Root.Children {
+		if v.Type == xmlx.NT_ELEMENT {
+			return v
+		}
+	}
+	return nil
+}
+
+// element appends a new element from the dsig namespace to parent.
+func element(parent *xmlx.Node, local string) *xmlx.Node {
+	n := xmlx.NewNode(xmlx.NT_ELEMENT)
+	n.Name = xml.Name{Space: NS, Local: local}
+	parent.AddChild(n)
+	return n
+}
+
+// child returns the first child element of n from the dsig namespace with the
+// given name, or nil.
+func child(n *xmlx.Node, local string) *xmlx.Node {
+	for _, v := range n.Children {
+		if v.Type == xmlx.NT_ELEMENT && v.Name.Space == NS && v.Name.Local == local {
+			return v
+		}
+	}
+	return nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
@@ -0,0 +1,155 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package dsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-pkg-xmlx"
+)
+
+const testDoc = `<?xml version="1.0" encoding="UTF-8"?>
+<r:Response xmlns:r="urn:test:response" ID="resp">
+	<r:Assertion ID="a1" xmlns:x="urn:unused">
+		<r:Subject>alice</r:Subject>
+	</r:Assertion>
+	<r:Status>ok</r:Status>
+</r:Response>`
+
+func testKey(t *testing.T, signer crypto.Signer) (*Key, *x509.CertPool) {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xmlx test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &Key{Signer: signer, Certificates: []*x509.Certificate{cert}}, pool
+}
+
+// reload serializes and reloads doc, so verification works on parsed input.
+func reload(t *testing.T, doc *xmlx.Document) *xmlx.Document {
+	res := xmlx.New()
+	if err := res.LoadString(doc.SaveString(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestSignVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signer := range []crypto.Signer{rsaKey, ecKey} {
+		key, pool := testKey(t, signer)
+
+		for _, refs := range [][]string{nil, {"a1"}, {"resp", "a1"}} {
+			doc := xmlx.New()
+			if err := doc.LoadString(testDoc, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Sign(doc, key, refs); err != nil {
+				t.Fatalf("%T %v: %v", signer, refs, err)
+			}
+
+			signed := reload(t, doc)
+			nodes, err := Verify(signed, pool)
+			if err != nil {
+				t.Fatalf("%T %v: %v", signer, refs, err)
+			}
+
+			if len(refs) > 0 && nodes[len(nodes)-1].As("", "ID") != "a1" {
+				t.Errorf("%T %v: wrong node returned", signer, refs)
+			}
+
+			// Any change to the signed content must be detected.
+			signed.SelectNode("urn:test:response", "Subject").SetValue("mallory")
+			if _, err := Verify(signed, pool); err == nil {
+				t.Errorf("%T %v: tampered document verified", signer, refs)
+			}
+		}
+
+		// Content outside the referenced element may change.
+		doc := xmlx.New()
+		doc.LoadString(testDoc, nil)
+		if _, err := Sign(doc, key, []string{"a1"}); err != nil {
+			t.Fatal(err)
+		}
+
+		signed := reload(t, doc)
+		signed.SelectNode("urn:test:response", "Status").SetValue("changed")
+		if _, err := Verify(signed, pool); err != nil {
+			t.Errorf("%T: %v", signer, err)
+		}
+
+		// Certificates must chain up to the given roots.
+		_, other := testKey(t, mustECKey(t))
+		if _, err := Verify(reload(t, doc), other); err == nil {
+			t.Errorf("%T: untrusted certificate accepted", signer)
+		}
+	}
+}
+
+func TestVerifyDuplicateId(t *testing.T) {
+	key, pool := testKey(t, mustECKey(t))
+
+	doc := xmlx.New()
+	doc.LoadString(testDoc, nil)
+	if _, err := Sign(doc, key, []string{"a1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second element with the signed Id must not be mistaken for the signed one.
+	s := strings.Replace(doc.SaveString(), "<r:Status>", `<r:Status ID="a1">`, 1)
+	forged := xmlx.New()
+	if err := forged.LoadString(s, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Verify(forged, pool); err == nil {
+		t.Errorf("duplicate Id accepted")
+	}
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
@@ -0,0 +1,490 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+	A minimal DTD reader. It only collects general entity declarations, so the
+	entities used in a document can be resolved by the xml decoder. Parameter
+	entities and conditional sections are expanded as far as needed to find
+	these declarations. Everything else is skipped.
+*/
+
+// Maximum nesting of external DTD parts and entity references.
+const dtdMaxDepth = 16
+
+// Maximum total size of the entity values declared in a DTD, after expanding
+// the references in them.
+const dtdMaxSize = 1 << 20
+
+type dtdParser struct {
+	catalog *Catalog
+	entity  map[string]string
+	params  map[string]*dtdParam
+	depth   int
+	nesting map[string]int // Depth of the entity references in each value.
+	size    int            // Total size of the expanded entity values.
+}
+
+type dtdParam struct {
+	value    string
+	publicId string
+	systemId string
+	base     string
+	external bool
+}
+
+// loadDocType processes a DOCTYPE directive. Entities declared in its internal
+// subset are added to the document's entity map if InternalEntities is set.
+// If the document has a catalog, entities declared in the external subset are
+// added as well.
+func (this *Document) loadDocType(directive string) error {
+	s := strings.TrimSpace(strings.TrimPrefix(directive, "DOCTYPE"))
+
+	var subset string
+	if i := strings.IndexByte(s, '['); i > -1 {
+		if j := strings.LastIndexByte(s, ']'); j > i {
+			subset = s[i+1 : j]
+		}
+		s = s[:i]
+	}
+
+	publicId, systemId := parseExternalId(s)
+
+	if this.Entity == nil {
+		this.Entity = make(map[string]string)
+	}
+
+	p := &dtdParser{
+		catalog: this.Catalog,
+		entity:  this.Entity,
+		params:  make(map[string]*dtdParam),
+		nesting: make(map[string]int),
+	}
+
+	// The internal subset is read first; its declarations take precedence.
+	if this.InternalEntities {
+		if err := p.parse(subset, this.BaseURI); err != nil {
+			return err
+		}
+	}
+
+	if this.Catalog == nil || (len(publicId) == 0 && len(systemId) == 0) {
+		return nil
+	}
+	return p.load(publicId, systemId, this.BaseURI)
+}
+
+// parseExternalId extracts the public and system identifiers from the part of
+// a DOCTYPE directive preceding the internal subset. (eg: `html PUBLIC "a" "b"`)
+func parseExternalId(s string) (publicId, systemId string) {
+	f := splitQuoted(s)
+	for i := 0; i < len(f); i++ {
+		switch f[i] {
+		case "PUBLIC":
+			if i+1 < len(f) {
+				publicId = unquote(f[i+1])
+			}
+			if i+2 < len(f) {
+				systemId = unquote(f[i+2])
+			}
+			return
+		case "SYSTEM":
+			if i+1 < len(f) {
+				systemId = unquote(f[i+1])
+			}
+			return
+		}
+	}
+	return
+}
+
+// splitQuoted splits s on whitespace, keeping quoted strings intact.
+func splitQuoted(s string) []string {
+	var list []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				return append(list, s[i:])
+			}
+			list = append(list, s[i:i+j+2])
+			i += j + 2
+		default:
+			j := strings.IndexAny(s[i:], " \t\r\n\"'")
+			if j < 0 {
+				return append(list, s[i:])
+			}
+			list = append(list, s[i:i+j])
+			i += j
+		}
+	}
+	return list
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// load reads and parses the external DTD part with the given identifiers.
+// Parts which can not be resolved to a local resource are ignored, as is
+// everything external if there is no catalog.
+func (this *dtdParser) load(publicId, systemId, base string) error {
+	if this.catalog == nil {
+		return nil
+	}
+
+	if this.depth >= dtdMaxDepth {
+		return fmt.Errorf("xmlx: DTD nesting exceeds %d levels", dtdMaxDepth)
+	}
+
+	r, uri, err := this.catalog.openEntity(publicId, systemId, base)
+	if err != nil {
+		if len(uri) == 0 {
+			return nil // Not available offline.
+		}
+		return err
+	}
+
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	this.depth++
+	defer func() { this.depth-- }()
+	return this.parse(string(data), uri)
+}
+
+// parse reads the declarations in the given DTD text.
+func (this *dtdParser) parse(s, base string) error {
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "<!--"):
+			i = skipPast(s, i+4, "-->")
+
+		case strings.HasPrefix(s[i:], "<?"):
+			i = skipPast(s, i+2, "?>")
+
+		case strings.HasPrefix(s[i:], "<!["):
+			end, err := this.conditional(s, i+3, base)
+			if err != nil {
+				return err
+			}
+			i = end
+
+		case strings.HasPrefix(s[i:], "<!ENTITY"):
+			end := declEnd(s, i)
+			if end < i+8 || s[end] != '>' {
+				return fmt.Errorf("xmlx: unterminated ENTITY declaration in DTD")
+			}
+			if err := this.declare(s[i+8:end], base); err != nil {
+				return err
+			}
+			i = end + 1
+
+		case strings.HasPrefix(s[i:], "<!"):
+			i = declEnd(s, i) + 1
+
+		case s[i] == '%':
+			j := strings.IndexByte(s[i:], ';')
+			if j < 0 {
+				return nil
+			}
+			if err := this.expandParam(s[i+1:i+j], base); err != nil {
+				return err
+			}
+			i += j + 1
+
+		default:
+			i++
+		}
+	}
+	return nil
+}
+
+// conditional handles an INCLUDE or IGNORE section starting at s[i:], right
+// after the "<![". Returns the offset just past the section.
+func (this *dtdParser) conditional(s string, i int, base string) (int, error) {
+	j := strings.IndexByte(s[i:], '[')
+	if j < 0 {
+		return len(s), nil
+	}
+
+	keyword, err := this.replaceParams(strings.TrimSpace(s[i : i+j]))
+	if err != nil {
+		return len(s), err
+	}
+	start := i + j + 1
+
+	// Find the matching "]]>", taking nested sections into account.
+	end, nest := start, 1
+	for end < len(s) && nest > 0 {
+		switch {
+		case strings.HasPrefix(s[end:], "<!["):
+			nest++
+			end += 3
+		case strings.HasPrefix(s[end:], "]]>"):
+			nest--
+			end += 3
+		default:
+			end++
+		}
+	}
+
+	if strings.TrimSpace(keyword) == "INCLUDE" && end-3 >= start {
+		if err := this.parse(s[start:end-3], base); err != nil {
+			return end, err
+		}
+	}
+	return end, nil
+}
+
+// declare handles the body of an ENTITY declaration.
+func (this *dtdParser) declare(decl, base string) error {
+	f := splitQuoted(decl)
+	if len(f) < 2 {
+		return nil
+	}
+
+	param := f[0] == "%"
+	if param {
+		f = f[1:]
+		if len(f) < 2 {
+			return nil
+		}
+	}
+
+	name := f[0]
+	p := &dtdParam{base: base}
+	switch f[1] {
+	case "PUBLIC":
+		p.external = true
+		if len(f) > 2 {
+			p.publicId = unquote(f[2])
+		}
+		if len(f) > 3 {
+			p.systemId = unquote(f[3])
+		}
+	case "SYSTEM":
+		p.external = true
+		if len(f) > 2 {
+			p.systemId = unquote(f[2])
+		}
+	default:
+		v, err := this.replaceParams(unquote(f[1]))
+		if err != nil {
+			return err
+		}
+		p.value = v
+	}
+
+	// The first declaration of an entity is binding.
+	if param {
+		if _, ok := this.params[name]; !ok {
+			this.params[name] = p
+		}
+		return nil
+	}
+
+	switch name {
+	case "lt", "gt", "amp", "apos", "quot":
+		return nil
+	}
+
+	if _, ok := this.entity[name]; ok || p.external {
+		return nil
+	}
+
+	v, depth, err := this.replaceRefs(p.value)
+	if err != nil {
+		return err
+	}
+	if depth > dtdMaxDepth {
+		return fmt.Errorf("xmlx: entity %q nests references more than %d levels deep", name, dtdMaxDepth)
+	}
+
+	this.entity[name] = v
+	this.nesting[name] = depth
+	return nil
+}
+
+// expandParam processes a parameter entity reference in the DTD.
+func (this *dtdParser) expandParam(name, base string) error {
+	p, ok := this.params[name]
+	if !ok {
+		return nil
+	}
+
+	if p.external {
+		return this.load(p.publicId, p.systemId, p.base)
+	}
+
+	if this.depth >= dtdMaxDepth {
+		return fmt.Errorf("xmlx: DTD nesting exceeds %d levels", dtdMaxDepth)
+	}
+
+	// Each expansion counts, so repeated references can not multiply the
+	// work without bound.
+	this.size += len(p.value)
+	if err := this.check(0); err != nil {
+		return err
+	}
+
+	this.depth++
+	defer func() { this.depth-- }()
+	return this.parse(p.value, base)
+}
+
+// replaceParams substitutes references to internal parameter entities.
+func (this *dtdParser) replaceParams(s string) (string, error) {
+	for n := 0; n < dtdMaxDepth && strings.IndexByte(s, '%') > -1; n++ {
+		var b strings.Builder
+		for i := 0; i < len(s); i++ {
+			j := strings.IndexByte(s[i:], ';')
+			if s[i] != '%' || j < 0 {
+				b.WriteByte(s[i])
+				continue
+			}
+
+			p, ok := this.params[s[i+1:i+j]]
+			if !ok || p.external {
+				b.WriteByte(s[i])
+				continue
+			}
+
+			b.WriteString(p.value)
+			i += j
+
+			if err := this.check(b.Len()); err != nil {
+				return "", err
+			}
+		}
+
+		if b.String() == s {
+			break
+		}
+		s = b.String()
+	}
+	return s, nil
+}
+
+// replaceRefs substitutes character references and references to already
+// known general entities in an entity value. Returns the expanded value and
+// the depth of the entity references in it. The value counts towards the
+// maximum size of the entities in the DTD.
+func (this *dtdParser) replaceRefs(s string) (string, int, error) {
+	if strings.IndexByte(s, '&') < 0 {
+		this.size += len(s)
+		return s, 0, this.check(0)
+	}
+
+	depth := 0
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		j := strings.IndexByte(s[i:], ';')
+		if s[i] != '&' || j < 0 {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		ref := s[i+1 : i+j]
+		if v, ok := this.resolveRef(ref); ok {
+			if d := this.nesting[ref] + 1; d > depth && !strings.HasPrefix(ref, "#") {
+				depth = d
+			}
+			if err := this.check(b.Len() + len(v)); err != nil {
+				return "", 0, err
+			}
+			b.WriteString(v)
+			i += j
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	this.size += b.Len()
+	return b.String(), depth, this.check(0)
+}
+
+// check returns an error if n more bytes of expanded entity values exceed the
+// maximum size of a DTD.
+func (this *dtdParser) check(n int) error {
+	if this.size+n > dtdMaxSize {
+		return fmt.Errorf("xmlx: entities in DTD expand to more than %d bytes", dtdMaxSize)
+	}
+	return nil
+}
+
+func (this *dtdParser) resolveRef(ref string) (string, bool) {
+	if strings.HasPrefix(ref, "#") {
+		var n uint64
+		var err error
+		if strings.HasPrefix(ref, "#x") {
+			n, err = strconv.ParseUint(ref[2:], 16, 32)
+		} else {
+			n, err = strconv.ParseUint(ref[1:], 10, 32)
+		}
+		if err != nil || !utf8.ValidRune(rune(n)) {
+			return "", false
+		}
+		return string(rune(n)), true
+	}
+
+	switch ref {
+	case "lt":
+		return "<", true
+	case "gt":
+		return ">", true
+	case "amp":
+		return "&", true
+	case "apos":
+		return "'", true
+	case "quot":
+		return `"`, true
+	}
+
+	v, ok := this.entity[ref]
+	return v, ok
+}
+
+// skipPast returns the offset just past the first occurrence of end in s[i:].
+func skipPast(s string, i int, end string) int {
+	if j := strings.Index(s[i:], end); j > -1 {
+		return i + j + len(end)
+	}
+	return len(s)
+}
+
+// declEnd returns the offset of the '>' closing the declaration starting at
+// s[i:]. Quoted strings are skipped.
+func declEnd(s string, i int) int {
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			if j := strings.IndexByte(s[i+1:], s[i]); j > -1 {
+				i += j + 1
+			}
+		case '>':
+			return i
+		}
+	}
+	return len(s) - 1
+}
@@ -0,0 +1,188 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+/*
+	Output encodings. The printer always produces utf-8; an encoder placed
+	between its buffer and the destination converts that to the charset named
+	by Document.Encoding. Characters in text and attribute values which the
+	charset can not represent are replaced by numeric character references
+	before they reach the encoder. Anywhere else, eg: in names or comments,
+	they cause the save to fail.
+*/
+
+// A supported output charset.
+type charset struct {
+	name   string
+	single func(r rune) (byte, bool) // Encodes a rune in single byte charsets.
+	utf16  bool
+	little bool // Little endian byte order for utf-16.
+	bom    bool // Write a byte order mark for utf-16.
+}
+
+// lookupCharset returns the charset with the given name. Returns nil for
+// utf-8, which needs no conversion.
+func lookupCharset(name string) (*charset, error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	case "us-ascii", "ascii":
+		return &charset{name: name, single: encodeASCII}, nil
+	case "iso-8859-1", "iso8859-1", "latin1":
+		return &charset{name: name, single: encodeLatin1}, nil
+	case "windows-1252", "cp1252":
+		return &charset{name: name, single: encodeWindows1252}, nil
+	case "utf-16":
+		return &charset{name: name, utf16: true, bom: true}, nil
+	case "utf-16be":
+		return &charset{name: name, utf16: true}, nil
+	case "utf-16le":
+		return &charset{name: name, utf16: true, little: true}, nil
+	}
+	return nil, fmt.Errorf("xmlx: unsupported encoding %q", name)
+}
+
+// encodable returns true if r can be represented in this charset.
+func (this *charset) encodable(r rune) bool {
+	if this.utf16 {
+		return true
+	}
+	_, ok := this.single(r)
+	return ok
+}
+
+// refs returns s with the characters this charset can not represent replaced
+// by numeric character references.
+func (this *charset) refs(s string) string {
+	if this == nil || this.utf16 {
+		return s
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool { return !this.encodable(r) })
+	if i < 0 {
+		return s
+	}
+
+	var b strings.Builder
+	b.WriteString(s[:i])
+	for _, r := range s[i:] {
+		if this.encodable(r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteString(Utf8ToEntity(string(r)))
+		}
+	}
+	return b.String()
+}
+
+// encoder converts utf-8 written to it into a charset, and passes the result
+// on to w.
+type encoder struct {
+	w       io.Writer
+	cs      *charset
+	partial []byte // Incomplete utf-8 sequence left by the previous write.
+	buf     []byte
+	started bool
+}
+
+func (this *encoder) Write(p []byte) (int, error) {
+	data := p
+	if len(this.partial) > 0 {
+		data = append(this.partial, p...)
+		this.partial = nil
+	}
+
+	this.buf = this.buf[:0]
+	if !this.started && this.cs.bom {
+		this.buf = this.appendUnit(this.buf, 0xFEFF)
+	}
+	this.started = true
+
+	for i := 0; i < len(data); {
+		if !utf8.FullRune(data[i:]) {
+			this.partial = append([]byte(nil), data[i:]...)
+			break
+		}
+
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			return 0, fmt.Errorf("xmlx: invalid utf-8 in output for encoding %q", this.cs.name)
+		}
+		i += size
+
+		if !this.cs.utf16 {
+			c, ok := this.cs.single(r)
+			if !ok {
+				return 0, fmt.Errorf("xmlx: character %U can not be represented in encoding %q", r, this.cs.name)
+			}
+			this.buf = append(this.buf, c)
+			continue
+		}
+
+		if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+			this.buf = this.appendUnit(this.buf, r1)
+			this.buf = this.appendUnit(this.buf, r2)
+		} else {
+			this.buf = this.appendUnit(this.buf, r)
+		}
+	}
+
+	if _, err := this.w.Write(this.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// close reports an incomplete utf-8 sequence at the end of the output.
+func (this *encoder) close() error {
+	if len(this.partial) > 0 {
+		return fmt.Errorf("xmlx: invalid utf-8 in output for encoding %q", this.cs.name)
+	}
+	return nil
+}
+
+func (this *encoder) appendUnit(b []byte, r rune) []byte {
+	if this.cs.little {
+		return append(b, byte(r), byte(r>>8))
+	}
+	return append(b, byte(r>>8), byte(r))
+}
+
+func encodeASCII(r rune) (byte, bool) {
+	return byte(r), r < 0x80
+}
+
+func encodeLatin1(r rune) (byte, bool) {
+	return byte(r), r < 0x100
+}
+
+// Characters in the 0x80-0x9f range of windows-1252. Zero marks unused
+// positions.
+var windows1252 = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+}
+
+func encodeWindows1252(r rune) (byte, bool) {
+	if r < 0x80 || r >= 0xA0 && r < 0x100 {
+		return byte(r), true
+	}
+	for i, v := range windows1252 {
+		if v == r && v != 0 {
+			return byte(0x80 + i), true
+		}
+	}
+	return 0, false
+}
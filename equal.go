@@ -0,0 +1,208 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"strconv"
+	"strings"
+)
+
+// EqualOptions controls which differences Node.Equal ignores.
+type EqualOptions struct {
+	IgnoreWhitespace bool // Skip text consisting of whitespace only.
+	IgnoreComments   bool // Skip comments.
+	IgnoreProcInst   bool // Skip processing instructions.
+	IgnoreAttrOrder  bool // Compare attributes regardless of their order.
+	IgnorePrefixes   bool // Compare names by namespace uri only, and skip namespace declarations.
+	NormalizeNumbers bool // Compare text and attribute values which are numbers by value. (eg: "1.50" equals "1.5")
+}
+
+// Returns true if this node and other, including their descendants, are
+// equal as far as the given options are concerned. Adjacent text nodes are
+// compared as one, as are text nodes separated by skipped comments or
+// processing instructions. If the nodes differ, the path of the first
+// difference is returned as well; it uses the same syntax as the paths of
+// Diff, relative to the tree holding this node.
+func (this *Node) Equal(other *Node, opts EqualOptions) (bool, string) {
+	c := &comparer{opts: opts}
+	path := nodePath(this)
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	if c.node(this, other, nodePath(this)) {
+		return true, ""
+	}
+	if len(c.path) == 0 {
+		return false, path
+	}
+	return false, c.path
+}
+
+type comparer struct {
+	opts EqualOptions
+	path string // Location of the first difference.
+}
+
+// eqItem is a child node to be compared. Consecutive text nodes are joined
+// into one item.
+type eqItem struct {
+	node  *Node
+	value string
+}
+
+func (this *comparer) fail(path string) bool {
+	this.path = path
+	return false
+}
+
+func (this *comparer) node(x, y *Node, path string) bool {
+	if x.Type != y.Type {
+		return this.fail(path)
+	}
+
+	switch x.Type {
+	case NT_ELEMENT:
+		if x.Name != y.Name || !this.opts.IgnorePrefixes && elementPrefix(x) != elementPrefix(y) {
+			return this.fail(path)
+		}
+		if !this.attributes(x, y, path) {
+			return false
+		}
+	case NT_PROCINST:
+		if x.Target != y.Target {
+			return this.fail(path)
+		}
+	}
+
+	if !this.value(x.Value, y.Value) {
+		return this.fail(path)
+	}
+
+	if x.Type == NT_ELEMENT || x.Type == NT_ROOT {
+		return this.children(x, y, path)
+	}
+	return true
+}
+
+func (this *comparer) attributes(x, y *Node, path string) bool {
+	ax, ay := this.attrs(x), this.attrs(y)
+
+	for i, a := range ax {
+		b := findAttr(ay, a)
+		if !this.opts.IgnoreAttrOrder {
+			b = nil
+			if i < len(ay) && ay[i].Name == a.Name {
+				b = ay[i]
+			}
+		}
+
+		if b == nil || !this.value(a.Value, b.Value) {
+			return this.fail(attrPath(path, x, a))
+		}
+		if !this.opts.IgnorePrefixes && len(a.Name.Space) > 0 && x.spacePrefix(a.Name.Space) != y.spacePrefix(b.Name.Space) {
+			return this.fail(attrPath(path, x, a))
+		}
+	}
+
+	if len(ay) > len(ax) {
+		for _, b := range ay {
+			if findAttr(ax, b) == nil {
+				return this.fail(attrPath(path, y, b))
+			}
+		}
+	}
+	return true
+}
+
+// attrs returns the attributes of n to be compared.
+func (this *comparer) attrs(n *Node) []*Attr {
+	if !this.opts.IgnorePrefixes {
+		return n.Attributes
+	}
+
+	var list []*Attr
+	for _, a := range n.Attributes {
+		if !isNamespaceDecl(a) {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+func (this *comparer) children(x, y *Node, path string) bool {
+	cx, cy := this.items(x), this.items(y)
+
+	for i := 0; i < len(cx) && i < len(cy); i++ {
+		a, b := cx[i], cy[i]
+		p := path + "/" + pathStep(a.node, x.Children)
+
+		if a.node.Type == NT_TEXT && b.node.Type == NT_TEXT {
+			if !this.value(a.value, b.value) {
+				return this.fail(p)
+			}
+			continue
+		}
+
+		if !this.node(a.node, b.node, p) {
+			return false
+		}
+	}
+
+	switch {
+	case len(cx) > len(cy):
+		return this.fail(path + "/" + pathStep(cx[len(cy)].node, x.Children))
+	case len(cy) > len(cx):
+		return this.fail(path + "/" + pathStep(cy[len(cx)].node, y.Children))
+	}
+	return true
+}
+
+// items returns the children of n to be compared.
+func (this *comparer) items(n *Node) []eqItem {
+	var list []eqItem
+	for _, v := range n.Children {
+		switch {
+		case v.Type == NT_COMMENT && this.opts.IgnoreComments:
+		case v.Type == NT_PROCINST && this.opts.IgnoreProcInst:
+		case v.Type == NT_TEXT:
+			if last := len(list) - 1; last >= 0 && list[last].node.Type == NT_TEXT {
+				list[last].value += v.Value
+			} else {
+				list = append(list, eqItem{v, v.Value})
+			}
+		default:
+			list = append(list, eqItem{v, v.Value})
+		}
+	}
+
+	if !this.opts.IgnoreWhitespace {
+		return list
+	}
+
+	res := list[:0]
+	for _, v := range list {
+		if v.node.Type != NT_TEXT || len(strings.TrimLeft(v.value, " \t\r\n")) > 0 {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func (this *comparer) value(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if !this.opts.NormalizeNumbers {
+		return false
+	}
+
+	fa, err := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	if err != nil {
+		return false
+	}
+	fb, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	return err == nil && fa == fb
+}
@@ -0,0 +1,150 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileOptions controls how Document.SaveFileWith writes a file.
+type FileOptions struct {
+	Mode   os.FileMode // Permissions of the file. If zero, those of the existing file are kept, or 0644 for new files.
+	Atomic bool        // Write to a temporary file in the same directory and rename it into place.
+	Backup bool        // Keep the previous version of the file as path + ".bak".
+	Fsync  bool        // Flush the file, and for atomic saves its directory, to stable storage.
+}
+
+// Save the contents of this document to the supplied file, as described by
+// the given options. If the path is a symbolic link, the file it points to is
+// replaced.
+//
+// With Atomic set, readers see either the old or the new file, never a
+// partial one; together with Fsync, this holds across crashes as well. The
+// owner of the file is not preserved by atomic saves, since the file is
+// recreated.
+func (this *Document) SaveFileWith(path string, opts FileOptions) (err error) {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		path = p
+	}
+
+	mode := opts.Mode
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if mode == 0 {
+			mode = fi.Mode().Perm()
+		}
+		if opts.Backup {
+			if err = backupFile(path, path+".bak", fi.Mode().Perm(), opts.Atomic); err != nil {
+				return err
+			}
+		}
+	case os.IsNotExist(err):
+		if mode == 0 {
+			mode = 0644
+		}
+	default:
+		return err
+	}
+
+	if !opts.Atomic {
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		return this.writeFile(fd, mode, opts.Fsync)
+	}
+
+	dir, name := filepath.Split(path)
+	if len(dir) == 0 {
+		dir = "."
+	}
+
+	fd, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(fd.Name())
+		}
+	}()
+
+	if err = this.writeFile(fd, mode, opts.Fsync); err != nil {
+		return err
+	}
+
+	if err = os.Rename(fd.Name(), path); err != nil {
+		return err
+	}
+
+	if opts.Fsync {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// writeFile saves the document to fd and closes it.
+func (this *Document) writeFile(fd *os.File, mode os.FileMode, sync bool) error {
+	err := this.SaveStream(fd)
+	if err == nil {
+		err = fd.Chmod(mode)
+	}
+	if err == nil && sync {
+		err = fd.Sync()
+	}
+
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// backupFile makes dst a copy of src. If link is set, a hard link is used
+// where possible. That is only safe if src is replaced rather than rewritten.
+func backupFile(src, dst string, mode os.FileMode, link bool) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if link && os.Link(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
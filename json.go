@@ -0,0 +1,602 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSON conventions. See Convention.Style.
+const (
+	JSON_SIMPLE     = iota // Attributes as "@name", text as "#text". Text-only elements become values.
+	JSON_BADGERFISH        // Attributes as "@name", text as "$", namespaces in scope as "@xmlns".
+	JSON_PARKER            // Attributes are dropped, text-only elements become values. The root element is omitted.
+	JSON_GDATA             // Attributes as plain members, text as "$t". Prefixes are joined to names with "$".
+)
+
+// Convention controls how Node.ToJSON and FromJSON map between XML and JSON.
+//
+// Elements become object members named after the element, including its
+// prefix if it has one. Repeated elements with the same name become arrays.
+// Comments, processing instructions and the order of mixed content are lost.
+type Convention struct {
+	Style      byte     // One of the JSON_* constants.
+	ForceArray []string // Names of elements which always become arrays, even if they occur only once.
+	Coerce     bool     // Write numeric and boolean text and attribute values as JSON numbers and booleans.
+	Root       string   // Name of the root element created by FromJSON for JSON_PARKER. Defaults to "root".
+}
+
+var reg_jsonnumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// Write this node as JSON to the supplied writer, using the given convention.
+// If this is the root of a document, its document element is written.
+func (this *Node) ToJSON(w io.Writer, conv Convention) error {
+	n := this
+	if n.Type == NT_ROOT {
+		for _, v := range n.Children {
+			if v.Type == NT_ELEMENT {
+				n = v
+				break
+			}
+		}
+	}
+
+	if n.Type != NT_ELEMENT {
+		return errors.New("xmlx: no element to convert to JSON")
+	}
+
+	j := &jsonWriter{Writer: bufio.NewWriter(w), conv: conv, force: make(map[string]bool)}
+	for _, v := range conv.ForceArray {
+		j.force[v] = true
+	}
+
+	inscope := inheritedNamespaces(n.Parent)
+	if conv.Style == JSON_PARKER {
+		j.value(n, inscope)
+	} else {
+		j.WriteByte('{')
+		j.str(j.elementKey(n))
+		j.WriteByte(':')
+		j.value(n, inscope)
+		j.WriteByte('}')
+	}
+	return j.Flush()
+}
+
+type jsonWriter struct {
+	*bufio.Writer
+	conv  Convention
+	force map[string]bool
+}
+
+// A group of child elements with the same name.
+type jsonGroup struct {
+	key   string
+	nodes []*Node
+}
+
+// value writes the JSON value for element n.
+func (this *jsonWriter) value(n *Node, inscope map[string]string) {
+	inscope = applyNamespaces(inscope, n)
+	text := jsonText(n)
+	groups := this.groups(n)
+
+	var attrs []*Attr
+	for _, a := range n.Attributes {
+		switch {
+		case this.conv.Style == JSON_PARKER:
+		case this.conv.Style == JSON_BADGERFISH && isNamespaceDecl(a):
+		default:
+			attrs = append(attrs, a)
+		}
+	}
+
+	if this.conv.Style == JSON_PARKER || this.conv.Style == JSON_SIMPLE {
+		if len(attrs) == 0 && len(groups) == 0 {
+			if len(text) == 0 {
+				this.WriteString("null")
+			} else {
+				this.scalar(text)
+			}
+			return
+		}
+	}
+
+	first := true
+	this.WriteByte('{')
+
+	if this.conv.Style == JSON_BADGERFISH && len(inscope) > 0 {
+		this.member(&first, "@xmlns")
+		this.namespaces(inscope)
+	}
+
+	for _, a := range attrs {
+		this.member(&first, this.attrKey(n, a))
+		this.scalar(a.Value)
+	}
+
+	for _, g := range groups {
+		this.member(&first, g.key)
+		if len(g.nodes) == 1 && !this.force[g.key] {
+			this.value(g.nodes[0], inscope)
+			continue
+		}
+
+		this.WriteByte('[')
+		for i, v := range g.nodes {
+			if i > 0 {
+				this.WriteByte(',')
+			}
+			this.value(v, inscope)
+		}
+		this.WriteByte(']')
+	}
+
+	if len(text) > 0 && this.conv.Style != JSON_PARKER {
+		switch this.conv.Style {
+		case JSON_SIMPLE:
+			this.member(&first, "#text")
+		case JSON_BADGERFISH:
+			this.member(&first, "$")
+		case JSON_GDATA:
+			this.member(&first, "$t")
+		}
+		this.scalar(text)
+	}
+
+	this.WriteByte('}')
+}
+
+// namespaces writes the BadgerFish @xmlns object.
+func (this *jsonWriter) namespaces(inscope map[string]string) {
+	prefixes := make([]string, 0, len(inscope))
+	for p := range inscope {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	first := true
+	this.WriteByte('{')
+	for _, p := range prefixes {
+		if len(p) == 0 {
+			this.member(&first, "$")
+		} else {
+			this.member(&first, p)
+		}
+		this.str(inscope[p])
+	}
+	this.WriteByte('}')
+}
+
+// groups returns the child elements of n, grouped by name in order of their
+// first occurrence.
+func (this *jsonWriter) groups(n *Node) []*jsonGroup {
+	var list []*jsonGroup
+	index := make(map[string]*jsonGroup)
+	for _, v := range n.Children {
+		if v.Type != NT_ELEMENT {
+			continue
+		}
+
+		key := this.elementKey(v)
+		g, ok := index[key]
+		if !ok {
+			g = &jsonGroup{key: key}
+			index[key] = g
+			list = append(list, g)
+		}
+		g.nodes = append(g.nodes, v)
+	}
+	return list
+}
+
+func (this *jsonWriter) member(first *bool, key string) {
+	if !*first {
+		this.WriteByte(',')
+	}
+	*first = false
+	this.str(key)
+	this.WriteByte(':')
+}
+
+func (this *jsonWriter) elementKey(n *Node) string {
+	return this.qualify(elementPrefix(n), n.Name.Local)
+}
+
+func (this *jsonWriter) attrKey(n *Node, a *Attr) string {
+	var key string
+	switch {
+	case a.Name.Space == "xmlns":
+		key = this.qualify("xmlns", a.Name.Local)
+	case len(a.Name.Space) > 0:
+		key = this.qualify(n.spacePrefix(a.Name.Space), a.Name.Local)
+	default:
+		key = a.Name.Local
+	}
+
+	if this.conv.Style == JSON_GDATA {
+		return key
+	}
+	return "@" + key
+}
+
+func (this *jsonWriter) qualify(prefix, local string) string {
+	switch {
+	case len(prefix) == 0:
+		return local
+	case this.conv.Style == JSON_GDATA:
+		return prefix + "$" + local
+	}
+	return prefix + ":" + local
+}
+
+// scalar writes s as a string, or as a number or boolean if coercion applies.
+func (this *jsonWriter) scalar(s string) {
+	if this.conv.Coerce && (s == "true" || s == "false" || reg_jsonnumber.MatchString(s)) {
+		this.WriteString(s)
+		return
+	}
+	this.str(s)
+}
+
+// str writes s as a JSON string.
+func (this *jsonWriter) str(s string) {
+	this.WriteByte('"')
+	last := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		var esc string
+		switch {
+		case r == '"':
+			esc = `\"`
+		case r == '\\':
+			esc = `\\`
+		case r == '\n':
+			esc = `\n`
+		case r == '\r':
+			esc = `\r`
+		case r == '\t':
+			esc = `\t`
+		case r < 0x20 || r == 0x2028 || r == 0x2029:
+			esc = fmt.Sprintf(`\u%04x`, r)
+		case r == utf8.RuneError && size == 1:
+			esc = `�`
+		default:
+			i += size
+			continue
+		}
+
+		this.WriteString(s[last:i])
+		this.WriteString(esc)
+		i += size
+		last = i
+	}
+	this.WriteString(s[last:])
+	this.WriteByte('"')
+}
+
+// jsonText returns the text content of n, without surrounding whitespace.
+func jsonText(n *Node) string {
+	var b strings.Builder
+	for _, v := range n.Children {
+		if v.Type == NT_TEXT {
+			b.WriteString(v.Value)
+		}
+	}
+	b.WriteString(n.Value)
+	return strings.TrimSpace(b.String())
+}
+
+// Create an element from the JSON read from the supplied reader, using the
+// given convention. Except for JSON_PARKER, the JSON must be an object with a
+// single member, which becomes the element. Prefixed names are resolved
+// through the namespace declarations in the JSON; if there are none, the
+// prefix is used as the namespace.
+func FromJSON(r io.Reader, conv Convention) (*Node, error) {
+	j := &jsonReader{Decoder: json.NewDecoder(r), conv: conv}
+	j.UseNumber()
+
+	var n *Node
+	if conv.Style == JSON_PARKER {
+		name := conv.Root
+		if len(name) == 0 {
+			name = "root"
+		}
+
+		n = j.element(name)
+		tok, err := j.Token()
+		if err != nil {
+			return nil, err
+		}
+		if err = j.content(n, tok); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := j.delim('{'); err != nil {
+			return nil, err
+		}
+
+		tok, err := j.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := tok.(string)
+		if !ok {
+			return nil, errors.New("xmlx: JSON object has no members")
+		}
+
+		n = j.element(key)
+		if tok, err = j.Token(); err != nil {
+			return nil, err
+		}
+		if err = j.content(n, tok); err != nil {
+			return nil, err
+		}
+
+		if err = j.delim('}'); err != nil {
+			return nil, errors.New("xmlx: JSON object must have a single member")
+		}
+	}
+
+	resolvePrefixes(n, nil)
+	return n, nil
+}
+
+type jsonReader struct {
+	*json.Decoder
+	conv Convention
+}
+
+// delim reads the next token, which must be the given delimiter.
+func (this *jsonReader) delim(d json.Delim) error {
+	tok, err := this.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return fmt.Errorf("xmlx: expected %q in JSON", d)
+	}
+	return nil
+}
+
+// content applies the JSON value starting with tok to element n.
+func (this *jsonReader) content(n *Node, tok json.Token) error {
+	switch tok {
+	case json.Delim('{'):
+		return this.members(n)
+	case json.Delim('['):
+		return errors.New("xmlx: unexpected JSON array")
+	case nil:
+		return nil
+	}
+
+	s, err := jsonScalar(tok)
+	if err != nil {
+		return err
+	}
+	if len(s) > 0 {
+		t := NewNode(NT_TEXT)
+		t.Value = s
+		n.AddChild(t)
+	}
+	return nil
+}
+
+// members reads the members of an object into element n.
+func (this *jsonReader) members(n *Node) error {
+	for {
+		tok, err := this.Token()
+		if err != nil {
+			return err
+		}
+		if tok == json.Delim('}') {
+			return nil
+		}
+
+		key := tok.(string)
+		if tok, err = this.Token(); err != nil {
+			return err
+		}
+
+		switch this.conv.Style {
+		case JSON_SIMPLE:
+			switch {
+			case key == "#text":
+				err = this.content(n, tok)
+			case strings.HasPrefix(key, "@"):
+				err = this.attr(n, key[1:], tok)
+			default:
+				err = this.children(n, key, tok)
+			}
+
+		case JSON_BADGERFISH:
+			switch {
+			case key == "$":
+				err = this.content(n, tok)
+			case key == "@xmlns":
+				err = this.namespaces(n, tok)
+			case strings.HasPrefix(key, "@"):
+				err = this.attr(n, key[1:], tok)
+			default:
+				err = this.children(n, key, tok)
+			}
+
+		case JSON_GDATA:
+			switch {
+			case key == "$t":
+				err = this.content(n, tok)
+			case tok == json.Delim('{') || tok == json.Delim('['):
+				err = this.children(n, strings.Replace(key, "$", ":", 1), tok)
+			default:
+				err = this.attr(n, strings.Replace(key, "$", ":", 1), tok)
+			}
+
+		default:
+			err = this.children(n, key, tok)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// children adds the element or array of elements starting with tok to n.
+func (this *jsonReader) children(n *Node, key string, tok json.Token) error {
+	if tok != json.Delim('[') {
+		c := this.element(key)
+		n.AddChild(c)
+		return this.content(c, tok)
+	}
+
+	for {
+		tok, err := this.Token()
+		if err != nil {
+			return err
+		}
+		if tok == json.Delim(']') {
+			return nil
+		}
+
+		c := this.element(key)
+		n.AddChild(c)
+		if err = this.content(c, tok); err != nil {
+			return err
+		}
+	}
+}
+
+func (this *jsonReader) attr(n *Node, key string, tok json.Token) error {
+	s, err := jsonScalar(tok)
+	if err != nil {
+		return err
+	}
+
+	a := &Attr{Value: s}
+	a.Name.Space, a.Name.Local = splitQName(key)
+	n.Attributes = append(n.Attributes, a)
+	return nil
+}
+
+// namespaces reads a BadgerFish @xmlns object into declarations on n.
+func (this *jsonReader) namespaces(n *Node, tok json.Token) error {
+	if tok != json.Delim('{') {
+		return errors.New("xmlx: @xmlns must be a JSON object")
+	}
+
+	for {
+		tok, err := this.Token()
+		if err != nil {
+			return err
+		}
+		if tok == json.Delim('}') {
+			return nil
+		}
+
+		prefix := tok.(string)
+		if tok, err = this.Token(); err != nil {
+			return err
+		}
+
+		uri, err := jsonScalar(tok)
+		if err != nil {
+			return err
+		}
+
+		// Namespaces already declared by an ancestor are repeated in
+		// BadgerFish; only declare those which differ.
+		if prefix == "$" {
+			prefix = ""
+		}
+		if scope := inheritedNamespaces(n.Parent); scope[prefix] == uri {
+			continue
+		}
+
+		a := &Attr{Value: uri}
+		if len(prefix) == 0 {
+			a.Name.Local = "xmlns"
+		} else {
+			a.Name = xml.Name{Space: "xmlns", Local: prefix}
+		}
+		n.Attributes = append(n.Attributes, a)
+	}
+}
+
+// element creates an element for the given JSON key. Its namespace holds the
+// prefix until resolvePrefixes is called.
+func (this *jsonReader) element(key string) *Node {
+	n := NewNode(NT_ELEMENT)
+	n.Name.Space, n.Name.Local = splitQName(key)
+	return n
+}
+
+func jsonScalar(tok json.Token) (string, error) {
+	switch v := tok.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	case nil:
+		return "", nil
+	}
+	return "", errors.New("xmlx: expected a JSON string, number or boolean")
+}
+
+func splitQName(key string) (prefix, local string) {
+	if i := strings.IndexByte(key, ':'); i > -1 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// resolvePrefixes replaces the prefixes in the names of n and its
+// descendants with the namespaces they are bound to.
+func resolvePrefixes(n *Node, inscope map[string]string) {
+	inscope = applyNamespaces(inscope, n)
+
+	switch prefix := n.Name.Space; {
+	case prefix == "xml":
+		n.Name.Space = nsXML
+	case len(prefix) == 0:
+		n.Name.Space = inscope[""]
+	default:
+		if uri, ok := inscope[prefix]; ok {
+			n.Name.Space = uri
+		}
+	}
+
+	for _, a := range n.Attributes {
+		if isNamespaceDecl(a) {
+			continue
+		}
+		if a.Name.Space == "xml" {
+			a.Name.Space = nsXML
+		} else if uri, ok := inscope[a.Name.Space]; ok && len(a.Name.Space) > 0 {
+			a.Name.Space = uri
+		}
+	}
+
+	for _, v := range n.Children {
+		if v.Type == NT_ELEMENT {
+			resolvePrefixes(v, inscope)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+	Conversion between nodes and plain Go data. The content of an element maps
+	to a map[string]interface{} as follows:
+
+	- Attributes become "@name" members holding the value as a string. This
+	  includes namespace declarations, as "@xmlns" and "@xmlns:prefix".
+	- Child elements become members named after the element, including its
+	  prefix if it has one. Elements without attributes and child elements
+	  hold their text as a string, others a map of their own content. If an
+	  element name occurs more than once, the member holds a []interface{}
+	  with the values in document order.
+	- Text becomes the "#text" member. Whitespace between child elements is
+	  dropped.
+	- Mixed content, text other than whitespace next to child elements, is
+	  kept in order: the "#content" member holds a []interface{} of strings
+	  for text and single-member maps for elements. Child elements are not
+	  added as separate members in this case.
+	- Comments, processing instructions and directives are dropped.
+*/
+
+// Returns the content of this node as a map, following the rules described
+// above. For the root of a document, the map holds the document element as
+// its only member.
+func (this *Node) ToMap() map[string]interface{} {
+	m := make(map[string]interface{})
+
+	if this.Type == NT_ELEMENT {
+		for _, a := range this.Attributes {
+			m["@"+mapAttrKey(this, a)] = a.Value
+		}
+
+		if isMixed(this) {
+			m["#content"] = mixedContent(this)
+			return m
+		}
+	}
+
+	var keys []string
+	values := make(map[string][]interface{})
+	for _, v := range this.Children {
+		if v.Type != NT_ELEMENT {
+			continue
+		}
+
+		key := mapElementKey(v)
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = append(values[key], mapValue(v))
+	}
+
+	for _, k := range keys {
+		if list := values[k]; len(list) == 1 {
+			m[k] = list[0]
+		} else {
+			m[k] = list
+		}
+	}
+
+	if this.Type == NT_ELEMENT && len(keys) == 0 {
+		if text := mapText(this); len(text) > 0 {
+			m["#text"] = text
+		}
+	}
+	return m
+}
+
+// mapValue returns the value of element n for the map of its parent.
+func mapValue(n *Node) interface{} {
+	if len(n.Attributes) > 0 {
+		return n.ToMap()
+	}
+	for _, v := range n.Children {
+		if v.Type == NT_ELEMENT {
+			return n.ToMap()
+		}
+	}
+	return mapText(n)
+}
+
+// mixedContent returns the text and child elements of n in document order.
+func mixedContent(n *Node) []interface{} {
+	var list []interface{}
+	for _, v := range n.Children {
+		switch v.Type {
+		case NT_TEXT:
+			list = append(list, v.Value)
+		case NT_ELEMENT:
+			list = append(list, map[string]interface{}{mapElementKey(v): mapValue(v)})
+		}
+	}
+	if len(n.Value) > 0 {
+		list = append(list, n.Value)
+	}
+	return list
+}
+
+// isMixed returns true if n has both child elements and text other than
+// whitespace.
+func isMixed(n *Node) bool {
+	elements, text := false, len(n.Value) > 0
+	for _, v := range n.Children {
+		switch {
+		case v.Type == NT_ELEMENT:
+			elements = true
+		case v.Type == NT_TEXT && !isWhitespace(v):
+			text = true
+		}
+	}
+	return elements && text
+}
+
+func mapText(n *Node) string {
+	var s string
+	for _, v := range n.Children {
+		if v.Type == NT_TEXT {
+			s += v.Value
+		}
+	}
+	return s + n.Value
+}
+
+func mapElementKey(n *Node) string {
+	if prefix := elementPrefix(n); len(prefix) > 0 {
+		return prefix + ":" + n.Name.Local
+	}
+	return n.Name.Local
+}
+
+func mapAttrKey(n *Node, a *Attr) string {
+	switch {
+	case a.Name.Space == "xmlns":
+		return "xmlns:" + a.Name.Local
+	case len(a.Name.Space) > 0:
+		return n.spacePrefix(a.Name.Space) + ":" + a.Name.Local
+	}
+	return a.Name.Local
+}
+
+// Create an element with the given name and content. The map follows the
+// rules described for Node.ToMap. Since maps are unordered, attributes and
+// child elements are added sorted by name; use "#content" where order
+// matters. Values other than strings, slices and maps are converted with
+// fmt.Sprint, nil values become empty elements. Prefixed names are resolved
+// through the namespace declarations in the map; if there are none, the
+// prefix is used as the namespace.
+func FromMap(name string, m map[string]interface{}) *Node {
+	n := NewNode(NT_ELEMENT)
+	n.Name.Space, n.Name.Local = splitQName(name)
+	fillFromMap(n, m)
+	resolvePrefixes(n, nil)
+	return n
+}
+
+func fillFromMap(n *Node, m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := m[k]
+		switch {
+		case k == "#text":
+		case k == "#content":
+			addMapContent(n, v)
+		case len(k) > 1 && k[0] == '@':
+			a := &Attr{Value: mapScalar(v)}
+			a.Name.Space, a.Name.Local = splitQName(k[1:])
+			n.Attributes = append(n.Attributes, a)
+		default:
+			addMapValue(n, k, v)
+		}
+	}
+
+	if v, ok := m["#text"]; ok {
+		addMapText(n, mapScalar(v))
+	}
+}
+
+// addMapContent adds the items of a "#content" list to n.
+func addMapContent(n *Node, v interface{}) {
+	list, ok := v.([]interface{})
+	if !ok {
+		addMapText(n, mapScalar(v))
+		return
+	}
+
+	for _, item := range list {
+		if m, ok := item.(map[string]interface{}); ok {
+			fillFromMap(n, m)
+		} else {
+			addMapText(n, mapScalar(item))
+		}
+	}
+}
+
+// addMapValue adds the element or elements with the given name and value to n.
+func addMapValue(n *Node, key string, v interface{}) {
+	switch t := v.(type) {
+	case []interface{}:
+		for _, item := range t {
+			addMapValue(n, key, item)
+		}
+		return
+	case []map[string]interface{}:
+		for _, item := range t {
+			addMapValue(n, key, item)
+		}
+		return
+	case []string:
+		for _, item := range t {
+			addMapValue(n, key, item)
+		}
+		return
+	}
+
+	c := NewNode(NT_ELEMENT)
+	c.Name.Space, c.Name.Local = splitQName(key)
+	n.AddChild(c)
+
+	if m, ok := v.(map[string]interface{}); ok {
+		fillFromMap(c, m)
+	} else {
+		addMapText(c, mapScalar(v))
+	}
+}
+
+func addMapText(n *Node, s string) {
+	if len(s) == 0 {
+		return
+	}
+	t := NewNode(NT_TEXT)
+	t.Value = s
+	n.AddChild(t)
+}
+
+func mapScalar(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,222 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Move the elements and attributes in namespace oldURI among this node and
+// its descendants to newURI, and update the declarations binding oldURI.
+func (this *Node) RenameNamespace(oldURI, newURI string) {
+	if this.Type == NT_ELEMENT {
+		if this.Name.Space == oldURI {
+			this.rename(nil, xml.Name{Space: newURI, Local: this.Name.Local})
+		}
+
+		for _, a := range this.Attributes {
+			switch {
+			case isNamespaceDecl(a):
+				if a.Value == oldURI {
+					this.setAttrValue(a, newURI)
+				}
+			case a.Name.Space == oldURI:
+				this.rename(a, xml.Name{Space: newURI, Local: a.Name.Local})
+			}
+		}
+	}
+
+	for _, v := range this.Children {
+		v.RenameNamespace(oldURI, newURI)
+	}
+}
+
+// Rename the namespace prefix old to new in the declarations on this node
+// and its descendants. Since names hold namespace uris, elements and
+// attributes follow automatically. Returns an error, and changes nothing, if
+// either prefix is invalid or new is already declared in scope of this node
+// or one of its descendants.
+func (this *Node) ChangePrefix(old, new string) error {
+	for _, p := range []string{old, new} {
+		if !isNCName(p) || p == "xml" || p == "xmlns" {
+			return fmt.Errorf("xmlx: invalid prefix %q", p)
+		}
+	}
+
+	if _, ok := inheritedNamespaces(this)[new]; ok || this.declaresBelow(new) {
+		return fmt.Errorf("xmlx: prefix %q is already declared", new)
+	}
+
+	this.renamePrefix(old, new)
+	return nil
+}
+
+// declaresBelow returns true if a descendant of this node declares prefix.
+func (this *Node) declaresBelow(prefix string) bool {
+	for _, v := range this.Children {
+		if v.Type == NT_ELEMENT && (v.HasAttr("xmlns", prefix) || v.declaresBelow(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Node) renamePrefix(old, new string) {
+	for _, a := range this.Attributes {
+		if a.Name.Space == "xmlns" && a.Name.Local == old {
+			this.rename(a, xml.Name{Space: "xmlns", Local: new})
+		}
+	}
+
+	for _, v := range this.Children {
+		v.renamePrefix(old, new)
+	}
+}
+
+// Move the prefixed namespace declarations of the descendants of this node to
+// the node itself. Declarations which would change the meaning of a prefix,
+// because it is bound differently here or on the way down, stay where they
+// are; duplicates of bindings already in scope are removed. Default
+// namespace declarations are not moved, since they affect unprefixed names.
+// For a document root, declarations are moved to the document element.
+func (this *Node) HoistNamespaceDeclarations() {
+	root := this
+	if this.Type == NT_ROOT {
+		if root = documentElement(this); root == nil {
+			return
+		}
+	}
+
+	inscope := make(map[string]string)
+	for p, uri := range inheritedNamespaces(root) {
+		inscope[p] = uri
+	}
+	root.hoist(root, inscope, nil)
+}
+
+// hoist moves declarations from the descendants of this node to root.
+// inscope holds the bindings in scope for root, between the prefixes
+// declared by the nodes between root and this node.
+func (this *Node) hoist(root *Node, inscope map[string]string, between map[string]bool) {
+	for _, v := range this.Children {
+		if v.Type != NT_ELEMENT {
+			continue
+		}
+
+		for i := len(v.Attributes) - 1; i >= 0; i-- {
+			a := v.Attributes[i]
+			if a.Name.Space != "xmlns" || between[a.Name.Local] {
+				continue
+			}
+
+			if uri, ok := inscope[a.Name.Local]; !ok {
+				root.SetAttrNS("xmlns", a.Name.Local, a.Value)
+				inscope[a.Name.Local] = a.Value
+			} else if uri != a.Value {
+				continue
+			}
+			v.RemoveAttrNS("xmlns", a.Name.Local)
+		}
+
+		var declared []string
+		for _, a := range v.Attributes {
+			if a.Name.Space == "xmlns" {
+				declared = append(declared, a.Name.Local)
+			}
+		}
+
+		inner := between
+		if len(declared) > 0 {
+			inner = make(map[string]bool, len(between)+len(declared))
+			for p := range between {
+				inner[p] = true
+			}
+			for _, p := range declared {
+				inner[p] = true
+			}
+		}
+		v.hoist(root, inscope, inner)
+	}
+}
+
+// Remove the namespace declarations on this node and its descendants which no
+// element or attribute name in their scope uses. Prefixes used only in
+// attribute values or text, such as in xsi:type, are not detected; their
+// declarations are removed as well.
+func (this *Node) RemoveUnusedNamespaceDeclarations() {
+	if this.Type == NT_ELEMENT {
+		for i := len(this.Attributes) - 1; i >= 0; i-- {
+			a := this.Attributes[i]
+			if !isNamespaceDecl(a) {
+				continue
+			}
+
+			prefix := ""
+			if a.Name.Space == "xmlns" {
+				prefix = a.Name.Local
+			}
+			if !this.usesNamespace(prefix, a.Value, true) {
+				this.RemoveAttrNS(a.Name.Space, a.Name.Local)
+			}
+		}
+	}
+
+	for _, v := range this.Children {
+		v.RemoveUnusedNamespaceDeclarations()
+	}
+}
+
+// usesNamespace returns true if the binding of prefix to uri is used by this
+// node or a descendant, up to where the prefix is declared again.
+func (this *Node) usesNamespace(prefix, uri string, top bool) bool {
+	if this.Type != NT_ELEMENT {
+		return false
+	}
+
+	if !top {
+		for _, a := range this.Attributes {
+			if a.Name.Space == "xmlns" && a.Name.Local == prefix || len(prefix) == 0 && a.Name.Space == "" && a.Name.Local == "xmlns" {
+				return false
+			}
+		}
+	}
+
+	if this.Name.Space == uri {
+		return true
+	}
+	if len(prefix) > 0 {
+		for _, a := range this.Attributes {
+			if !isNamespaceDecl(a) && len(a.Name.Space) > 0 && a.Name.Space == uri {
+				return true
+			}
+		}
+	}
+
+	for _, v := range this.Children {
+		if v.usesNamespace(prefix, uri, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// rename changes the name of this node, or of its attribute a if it is set.
+func (this *Node) rename(a *Attr, name xml.Name) {
+	old := this.Name
+	if a != nil {
+		old, a.Name = a.Name, name
+	} else {
+		this.Name = name
+	}
+	this.record(MutationRecord{Type: MR_RENAME, Target: this, Attr: a, OldName: old, NewName: name})
+}
+
+// setAttrValue changes the value of attribute a of this node.
+func (this *Node) setAttrValue(a *Attr, value string) {
+	old := a.Value
+	a.Value = value
+	this.record(MutationRecord{Type: MR_ATTR_SET, Target: this, Attr: a, OldValue: old, NewValue: value})
+}
@@ -7,9 +7,10 @@ package xmlx
 import (
 	"bytes"
 	"encoding/xml"
-	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -24,6 +25,10 @@ const (
 // IndentPrefix holds the value for a single identation level, if one
 // chooses to want indentation in the node.String() and node.Bytes() output.
 // This would normally be set to a single tab, or a number of spaces.
+//
+// Note that only Document.SaveBytes consults it, to decide whether to put a
+// newline after the xml declaration. Use Document.SaveWith and
+// SaveOptions.Indent for indented output.
 var IndentPrefix = ""
 
 type Attr struct {
@@ -39,6 +44,8 @@ type Node struct {
 	Parent     *Node    // Parent node.
 	Value      string   // Node value.
 	Target     string   // procinst field.
+
+	owner *Document // Set on the root of a document whose changes are recorded.
 }
 
 func NewNode(tid byte) *Node {
@@ -52,7 +59,7 @@ func NewNode(tid byte) *Node {
 // This wraps the standard xml.Unmarshal function and supplies this particular
 // node as the content to be unmarshalled.
 func (this *Node) Unmarshal(obj interface{}) error {
-	return xml.NewDecoder(bytes.NewBuffer(this.bytes())).Decode(obj)
+	return xml.NewDecoder(bytes.NewBuffer(this.Bytes())).Decode(obj)
 }
 
 func (this *Node) GetValue() string {
@@ -68,11 +75,18 @@ func (this *Node) GetValue() string {
 
 // SetValue sets the value of the node to the given parameter.
 // It deletes all children of the node so the old data does not get back at node.GetValue
+// For text, comments, processing instructions and directives, the value of the
+// node itself is set.
 func (this *Node) SetValue(val string) {
+	if this.Type != NT_ELEMENT && this.Type != NT_ROOT {
+		this.setValue(val)
+		return
+	}
+
+	this.removeChildren()
 	t := NewNode(NT_TEXT)
 	t.Value = val
-	t.Parent = this
-	this.Children = []*Node{t} // brutally replace all other children
+	this.AddChild(t)
 }
 
 // Get node value as string
@@ -431,7 +445,9 @@ func rec_SelectNodes(cn *Node, namespace, name string, list *[]*Node, recurse bo
 }
 
 func (this *Node) RemoveNameSpace() {
-	this.Name.Space = ""
+	if len(this.Name.Space) > 0 {
+		this.rename(nil, xml.Name{Local: this.Name.Local})
+	}
 	//	this.RemoveAttr("xmlns") //This is questionable
 
 	for _, v := range this.Children {
@@ -439,53 +455,93 @@ func (this *Node) RemoveNameSpace() {
 	}
 }
 
-func (this *Node) RemoveAttr(name string) {
-	for i, v := range this.Attributes {
-		if name == v.Name.Local {
-			//Delete it
-			this.Attributes = append(this.Attributes[:i], this.Attributes[i+1:]...)
+// Remove the attribute with the given name and no namespace. Use
+// RemoveAttrNS for namespaced attributes.
+func (this *Node) RemoveAttr(name string) { this.RemoveAttrNS("", name) }
+
+// Set the attribute with the given name and no namespace, adding it if it
+// does not exist. Use SetAttrNS for namespaced attributes.
+func (this *Node) SetAttr(name, value string) { this.SetAttrNS("", name, value) }
+
+// Returns the attribute with the given namespace and name, or nil. The
+// namespace may be "*" to match any.
+func (this *Node) Attr(namespace, name string) *Attr {
+	for _, v := range this.Attributes {
+		if (namespace == "*" || namespace == v.Name.Space) && name == v.Name.Local {
+			return v
 		}
 	}
+	return nil
 }
 
-func (this *Node) SetAttr(name, value string) {
-	for _, v := range this.Attributes {
-		if name == v.Name.Local {
-			v.Value = value
-			return
+// Remove all attributes with the given namespace and name. The namespace may
+// be "*" to match any.
+func (this *Node) RemoveAttrNS(namespace, name string) {
+	for i := len(this.Attributes) - 1; i >= 0; i-- {
+		v := this.Attributes[i]
+		if (namespace == "*" || namespace == v.Name.Space) && name == v.Name.Local {
+			this.removeAttr(i)
+			this.record(MutationRecord{Type: MR_ATTR_REMOVE, Target: this, Attr: v, Index: i, OldValue: v.Value})
 		}
 	}
-	//Add
+}
+
+// Set the attribute with the given namespace and name, adding it if it does
+// not exist. The namespace is a uri; it should be declared in scope of this
+// node for the attribute to be saved with a proper prefix. The wildcard "*"
+// only applies to lookups; the call is ignored for it.
+func (this *Node) SetAttrNS(namespace, name, value string) {
+	if namespace == "*" {
+		return
+	}
+	if a := this.Attr(namespace, name); a != nil {
+		this.setAttrValue(a, value)
+		return
+	}
+
 	attr := new(Attr)
+	attr.Name.Space = namespace
 	attr.Name.Local = name
-	attr.Name.Space = ""
 	attr.Value = value
-	this.Attributes = append(this.Attributes, attr)
-	return
+	this.insertAttr(len(this.Attributes), attr)
+	this.record(MutationRecord{Type: MR_ATTR_ADD, Target: this, Attr: attr, Index: len(this.Attributes) - 1, NewValue: value})
+}
+
+// Set attribute value from an int
+func (this *Node) SetAttrInt(namespace, name string, value int64) {
+	this.SetAttrNS(namespace, name, strconv.FormatInt(value, 10))
+}
+
+// Set attribute value from an unsigned int
+func (this *Node) SetAttrUint(namespace, name string, value uint64) {
+	this.SetAttrNS(namespace, name, strconv.FormatUint(value, 10))
+}
+
+// Set attribute value from a float, in the shortest form which reads back
+// as the same value.
+func (this *Node) SetAttrFloat(namespace, name string, value float64) {
+	this.SetAttrNS(namespace, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// Set attribute value from a bool
+func (this *Node) SetAttrBool(namespace, name string, value bool) {
+	this.SetAttrNS(namespace, name, strconv.FormatBool(value))
+}
+
+// Set attribute value from a time, in RFC 3339 format as used by the
+// xsd:dateTime type.
+func (this *Node) SetAttrTime(namespace, name string, value time.Time) {
+	this.SetAttrNS(namespace, name, value.Format(time.RFC3339Nano))
 }
 
 // Convert node to appropriate []byte representation based on it's @Type.
 // Note that NT_ROOT is a special-case empty node used as the root for a
 // Document. This one has no representation by itself. It merely forwards the
 // String() call to it's child nodes.
-func (this *Node) Bytes() []byte { return this.bytes() }
-
-func (this *Node) bytes() (b []byte) {
-	switch this.Type {
-	case NT_PROCINST:
-		b = this.printProcInst()
-	case NT_COMMENT:
-		b = this.printComment()
-	case NT_DIRECTIVE:
-		b = this.printDirective()
-	case NT_ELEMENT:
-		b = this.printElement()
-	case NT_TEXT:
-		b = this.printText()
-	case NT_ROOT:
-		b = this.printRoot()
-	}
-	return
+func (this *Node) Bytes() []byte {
+	var b bytes.Buffer
+	this.SaveStream(&b)
+	return b.Bytes()
 }
 
 // Convert node to appropriate string representation based on it's @Type.
@@ -493,127 +549,231 @@ func (this *Node) bytes() (b []byte) {
 // Document. This one has no representation by itself. It merely forwards the
 // String() call to it's child nodes.
 func (this *Node) String() (s string) {
-	return string(this.bytes())
+	return string(this.Bytes())
 }
 
-func (this *Node) printRoot() []byte {
-	var b bytes.Buffer
-	for _, v := range this.Children {
-		b.Write(v.bytes())
-	}
-	return b.Bytes()
+// Write the node and its descendants to the supplied writer. Namespaces
+// without a prefix in scope are declared with generated prefixes; a node does
+// not know its document, so Document.PreferredPrefixes does not apply here.
+func (this *Node) SaveStream(w io.Writer) error {
+	p := newPrinter(w, SaveOptions{})
+	p.declareMissing(this, nil)
+	p.node(this, 0, false)
+	return p.Flush()
 }
 
-func (this *Node) printProcInst() []byte {
-	return []byte("<?" + this.Target + " " + this.Value + "?>")
+// spacePrefix resolves the given space (e.g. a url) to the prefix it was
+// assigned by an attribute by the current node, or one of its parents.
+// If no prefix was assigned, the space itself is returned.
+func (this *Node) spacePrefix(space string) string {
+	if prefix, ok := this.lookupPrefix(space, false); ok {
+		return prefix
+	}
+	return space
+}
+
+// lookupPrefix finds the prefix bound to the given space in the scope of the
+// current node. If def is set, the default namespace is considered as well,
+// in which case the prefix may be empty. Declarations shadowed by nearer ones
+// are skipped.
+func (this *Node) lookupPrefix(space string, def bool) (string, bool) {
+	switch space {
+	case nsXML:
+		return "xml", true
+	case "xmlns":
+		return "xmlns", true
+	}
+
+	var shadowed map[string]bool
+	for n := this; n != nil; n = n.Parent {
+		for _, a := range n.Attributes {
+			switch {
+			case a.Name.Space == "xmlns":
+				if shadowed[a.Name.Local] {
+					continue
+				}
+				if a.Value == space {
+					return a.Name.Local, true
+				}
+				if shadowed == nil {
+					shadowed = make(map[string]bool)
+				}
+				shadowed[a.Name.Local] = true
+
+			case len(a.Name.Space) == 0 && a.Name.Local == "xmlns" && def:
+				if a.Value == space {
+					return "", true
+				}
+				def = false
+			}
+		}
+	}
+	return "", false
 }
 
-func (this *Node) printComment() []byte {
-	return []byte("<!-- " + this.Value + " -->")
+// Add a child node
+func (this *Node) AddChild(t *Node) {
+	if t.Parent != nil {
+		t.Parent.RemoveChild(t)
+	}
+	this.insertChild(len(this.Children), t)
+	this.record(MutationRecord{Type: MR_INSERT, Target: this, Child: t, Index: len(this.Children) - 1})
 }
 
-func (this *Node) printDirective() []byte {
-	return []byte("<!" + this.Value + "!>")
-}
+// Remove a child node
+func (this *Node) RemoveChild(t *Node) {
+	p := -1
+	for i, v := range this.Children {
+		if v == t {
+			p = i
+			break
+		}
+	}
 
-func (this *Node) printText() []byte {
-	val := []byte(this.Value)
-	if len(this.Parent.Children) > 1 {
-		return val
+	if p == -1 {
+		return
 	}
-	var b bytes.Buffer
-	xml.EscapeText(&b, val)
-	return b.Bytes()
+
+	this.removeChild(p)
+	this.record(MutationRecord{Type: MR_REMOVE, Target: this, Child: t, Index: p})
 }
 
-func (this *Node) printElement() []byte {
-	var b bytes.Buffer
+// Insert a child node at position i. Positions outside the list of children
+// are clamped to its bounds. If t has a parent, it is removed from it first.
+// Nothing happens if t is this node or one of its ancestors.
+func (this *Node) InsertAt(i int, t *Node) {
+	if this.isInside(t) {
+		return
+	}
+	if t.Parent != nil {
+		t.Parent.RemoveChild(t)
+	}
 
-	if len(this.Name.Space) > 0 {
-		b.WriteRune('<')
-		b.WriteString(this.Name.Space)
-		b.WriteRune(':')
-		b.WriteString(this.Name.Local)
-	} else {
-		b.WriteRune('<')
-		b.WriteString(this.Name.Local)
+	switch {
+	case i < 0:
+		i = 0
+	case i > len(this.Children):
+		i = len(this.Children)
 	}
 
-	for _, v := range this.Attributes {
-		if len(v.Name.Space) > 0 {
-			prefix := this.spacePrefix(v.Name.Space)
-			b.WriteString(fmt.Sprintf(` %s:%s="%s"`, prefix, v.Name.Local, v.Value))
-		} else {
-			b.WriteString(fmt.Sprintf(` %s="%s"`, v.Name.Local, v.Value))
-		}
+	this.insertChild(i, t)
+	this.record(MutationRecord{Type: MR_INSERT, Target: this, Child: t, Index: i})
+}
+
+// Insert a child node before ref. If ref is nil, t is appended. Nothing
+// happens if ref is not a child of this node.
+func (this *Node) InsertBefore(t, ref *Node) {
+	switch {
+	case ref == nil:
+		this.InsertAt(len(this.Children), t)
+	case ref.Parent == this && t != ref && !this.isInside(t):
+		t.Detach()
+		this.InsertAt(indexOf(this.Children, ref), t)
 	}
+}
 
-	if len(this.Children) == 0 && len(this.Value) == 0 {
-		b.WriteString(" />")
-		return b.Bytes()
+// Insert a child node after ref. If ref is nil, t becomes the first child.
+// Nothing happens if ref is not a child of this node.
+func (this *Node) InsertAfter(t, ref *Node) {
+	switch {
+	case ref == nil:
+		this.InsertAt(0, t)
+	case ref.Parent == this && t != ref && !this.isInside(t):
+		t.Detach()
+		this.InsertAt(indexOf(this.Children, ref)+1, t)
 	}
+}
 
-	b.WriteRune('>')
+// Add a child node before all others.
+func (this *Node) Prepend(t *Node) { this.InsertAt(0, t) }
 
-	for _, v := range this.Children {
-		b.Write(v.bytes())
+// Replace the child node old with t. Nothing happens if old is not a child
+// of this node.
+func (this *Node) ReplaceChild(t, old *Node) {
+	if old.Parent != this || t == old || this.isInside(t) {
+		return
 	}
 
-	xml.EscapeText(&b, []byte(this.Value))
-	if len(this.Name.Space) > 0 {
-		b.WriteString("</")
-		b.WriteString(this.Name.Space)
-		b.WriteRune(':')
-		b.WriteString(this.Name.Local)
-		b.WriteRune('>')
-	} else {
-		b.WriteString("</")
-		b.WriteString(this.Name.Local)
-		b.WriteRune('>')
-	}
+	t.Detach()
+	i := indexOf(this.Children, old)
+	this.RemoveChild(old)
+	this.InsertAt(i, t)
+}
 
-	return b.Bytes()
+// Put t in the place of this node. Nothing happens if this node has no parent.
+func (this *Node) ReplaceWith(t *Node) {
+	if this.Parent != nil {
+		this.Parent.ReplaceChild(t, this)
+	}
 }
 
-// spacePrefix resolves the given space (e.g. a url) to the prefix it was
-// assigned by an attribute by the current node, or one of its parents.
-func (this *Node) spacePrefix(space string) string {
-	for _, attr := range this.Attributes {
-		if attr.Name.Space == "xmlns" && attr.Value == space {
-			return attr.Name.Local
-		}
+// Put w in the place of this node, and add this node to it as its last child.
+// If this node has no parent, it is only added to w.
+func (this *Node) Wrap(w *Node) {
+	if w.isInside(this) {
+		return
 	}
-	if this.Parent == nil {
-		return space
+	if this.Parent != nil {
+		this.Parent.ReplaceChild(w, this)
 	}
-	return this.Parent.spacePrefix(space)
+	w.AddChild(this)
 }
 
-// Add a child node
-func (this *Node) AddChild(t *Node) {
-	if t.Parent != nil {
-		t.Parent.RemoveChild(t)
+// Put the children of this node in its place, removing the node itself.
+// Nothing happens if this node has no parent.
+func (this *Node) Unwrap() {
+	p := this.Parent
+	if p == nil {
+		return
 	}
-	t.Parent = this
-	this.Children = append(this.Children, t)
+
+	i := indexOf(p.Children, this)
+	for len(this.Children) > 0 {
+		p.InsertAt(i+1, this.Children[len(this.Children)-1])
+	}
+	p.RemoveChild(this)
 }
 
-// Remove a child node
-func (this *Node) RemoveChild(t *Node) {
-	p := -1
-	for i, v := range this.Children {
-		if v == t {
-			p = i
-			break
-		}
+// Remove this node from its parent.
+func (this *Node) Detach() {
+	if this.Parent != nil {
+		this.Parent.RemoveChild(this)
 	}
+	this.Parent = nil
+}
 
-	if p == -1 {
-		return
+// Returns a deep copy of this node. The copy has no parent; its descendants
+// and attributes are copies as well.
+func (this *Node) Clone() *Node {
+	c := this.ShallowClone()
+	for _, v := range this.Children {
+		v = v.Clone()
+		v.Parent = c
+		c.Children = append(c.Children, v)
 	}
+	return c
+}
 
-	copy(this.Children[p:], this.Children[p+1:])
-	this.Children = this.Children[0 : len(this.Children)-1]
+// Returns a copy of this node and its attributes, without children and
+// parent.
+func (this *Node) ShallowClone() *Node {
+	c := NewNode(this.Type)
+	c.Name = this.Name
+	c.Value = this.Value
+	c.Target = this.Target
 
-	t.Parent = nil
+	for _, a := range this.Attributes {
+		c.Attributes = append(c.Attributes, &Attr{Name: a.Name, Value: a.Value})
+	}
+	return c
+}
+
+// isInside returns true if this node is n or one of its descendants.
+func (this *Node) isInside(n *Node) bool {
+	for p := this; p != nil; p = p.Parent {
+		if p == n {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,86 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import "encoding/xml"
+
+// Kinds of changes described by a MutationRecord.
+const (
+	MR_INSERT      = iota // A child node was inserted.
+	MR_REMOVE             // A child node was removed.
+	MR_ATTR_ADD           // An attribute was added.
+	MR_ATTR_REMOVE        // An attribute was removed.
+	MR_ATTR_SET           // The value of an attribute changed.
+	MR_VALUE              // The Value field of a node changed.
+	MR_RENAME             // The name of an element or attribute changed.
+)
+
+// MutationRecord describes a single change to a document.
+//
+// Changes are reported for the methods of Node which modify a tree:
+// AddChild, RemoveChild, InsertAt and the other insertion, replacement and
+// removal methods, SetValue, SetTextContent, Normalize, SetAttr, SetAttrNS,
+// RemoveAttr, RemoveAttrNS, the typed attribute setters and the namespace
+// refactoring methods. Methods which make several changes report each of
+// them; moving a node is reported as its removal and insertion.
+// Changes made by assigning to the fields of a node directly, or to nodes
+// which are not part of the document, are not reported.
+type MutationRecord struct {
+	Type     byte     // One of the MR_* constants.
+	Target   *Node    // The node whose children, attributes or value changed.
+	Child    *Node    // The inserted or removed child.
+	Attr     *Attr    // The added, removed or changed attribute.
+	Index    int      // Position of the inserted or removed child or attribute.
+	OldValue string   // Value of the attribute or node before the change.
+	NewValue string   // Value of the attribute or node after the change.
+	OldName  xml.Name // Name of the element or attribute before the change.
+	NewName  xml.Name // Name of the element or attribute after the change.
+	Replay   bool     // Set for changes made by Undo, Redo and Tx.Rollback.
+}
+
+// inverse returns the record of the change which reverts this one.
+func (this MutationRecord) inverse() MutationRecord {
+	switch this.Type {
+	case MR_INSERT:
+		this.Type = MR_REMOVE
+	case MR_REMOVE:
+		this.Type = MR_INSERT
+	case MR_ATTR_ADD:
+		this.Type = MR_ATTR_REMOVE
+	case MR_ATTR_REMOVE:
+		this.Type = MR_ATTR_ADD
+	}
+	this.OldValue, this.NewValue = this.NewValue, this.OldValue
+	this.OldName, this.NewName = this.NewName, this.OldName
+	return this
+}
+
+type observer struct {
+	fn func(MutationRecord)
+}
+
+// Register a function to be called after each change made to this document,
+// including those made by Undo, Redo and rolled back transactions. Functions
+// are called in the order they were registered. Returns a function which
+// unregisters it again.
+//
+// Loading or building the document keeps its observers; the old content is
+// reported as removed, and the new content as inserted. Assigning a new Root
+// directly disconnects them, until Observe or Begin is called again.
+func (this *Document) Observe(fn func(MutationRecord)) func() {
+	this.track()
+
+	o := &observer{fn: fn}
+	this.observers = append(this.observers, o)
+
+	return func() {
+		for i, v := range this.observers {
+			if v == o {
+				this.observers = append(this.observers[:i:i], this.observers[i+1:]...)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Package represents a zip based container of XML parts. Office Open XML
+// (.docx, .xlsx, .pptx) and OpenDocument (.odt, .ods, .odp) files are stored
+// this way. Parts can be loaded into a Document, modified and written back
+// into a new container, while all other entries are copied untouched.
+type Package struct {
+	fd      *os.File
+	zr      *zip.Reader
+	changed map[string]*Document // Replaced or added parts.
+	added   []string             // Names of parts not present in the original.
+}
+
+// Open the zip container at the given path.
+func OpenPackage(path string) (*Package, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(fd, fi.Size())
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return &Package{
+		fd:      fd,
+		zr:      zr,
+		changed: make(map[string]*Document),
+	}, nil
+}
+
+// Close the underlying file. Parts can no longer be loaded or saved after
+// this call.
+func (this *Package) Close() error { return this.fd.Close() }
+
+// Returns the names of all parts in the container, in the order in which they
+// are stored, followed by any parts added through SetPart.
+func (this *Package) Parts() []string {
+	list := make([]string, 0, len(this.zr.File)+len(this.added))
+	for _, f := range this.zr.File {
+		list = append(list, f.Name)
+	}
+	return append(list, this.added...)
+}
+
+// Returns true if the container holds a part with the given name.
+func (this *Package) HasPart(name string) bool {
+	if _, ok := this.changed[name]; ok {
+		return true
+	}
+	return this.file(name) != nil
+}
+
+// Open the raw contents of the named part. Parts replaced through SetPart are
+// returned in their new form.
+func (this *Package) Open(name string) (io.ReadCloser, error) {
+	if doc, ok := this.changed[name]; ok {
+		r, w := io.Pipe()
+		go func() { w.CloseWithError(doc.SaveStream(w)) }()
+		return r, nil
+	}
+
+	f := this.file(name)
+	if f == nil {
+		return nil, os.ErrNotExist
+	}
+	return f.Open()
+}
+
+// Load the named part into a new Document.
+func (this *Package) LoadPart(name string, charset CharsetFunc) (*Document, error) {
+	if doc, ok := this.changed[name]; ok {
+		return doc, nil
+	}
+
+	r, err := this.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	doc := New()
+	if err = doc.LoadStream(r, charset); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Replace the named part with the given document. If the part does not exist
+// yet, it is added to the end of the container. The document is serialized
+// when the package is saved, so later changes to it are included.
+func (this *Package) SetPart(name string, doc *Document) {
+	if _, ok := this.changed[name]; !ok && this.file(name) == nil {
+		this.added = append(this.added, name)
+	}
+	this.changed[name] = doc
+}
+
+// Write the container, including all modified parts, to the supplied writer.
+func (this *Package) SaveStream(w io.Writer) (err error) {
+	zw := zip.NewWriter(w)
+
+	for _, f := range this.zr.File {
+		doc, ok := this.changed[f.Name]
+		if !ok {
+			if err = zw.Copy(f); err != nil {
+				return
+			}
+			continue
+		}
+
+		hdr := zip.FileHeader{
+			Name:     f.Name,
+			Comment:  f.Comment,
+			Method:   f.Method,
+			Modified: time.Now(),
+		}
+
+		if err = this.writePart(zw, &hdr, doc); err != nil {
+			return
+		}
+	}
+
+	for _, name := range this.added {
+		hdr := zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		}
+
+		if err = this.writePart(zw, &hdr, this.changed[name]); err != nil {
+			return
+		}
+	}
+
+	return zw.Close()
+}
+
+// Write the container, including all modified parts, to the supplied file.
+// The file may not be the one the package was opened from.
+func (this *Package) SaveFile(path string) (err error) {
+	if fi, err := os.Stat(path); err == nil {
+		if src, err := this.fd.Stat(); err == nil && os.SameFile(fi, src) {
+			return errors.New("xmlx: cannot save package over its source file")
+		}
+	}
+
+	var fd *os.File
+	if fd, err = os.Create(path); err != nil {
+		return
+	}
+
+	if err = this.SaveStream(fd); err != nil {
+		fd.Close()
+		return
+	}
+	return fd.Close()
+}
+
+func (this *Package) writePart(zw *zip.Writer, hdr *zip.FileHeader, doc *Document) error {
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	return doc.SaveStream(w)
+}
+
+func (this *Package) file(name string) *zip.File {
+	for _, f := range this.zr.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
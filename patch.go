@@ -0,0 +1,874 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	XML patch operations as described in RFC 5261. A patch is an element
+	holding <add>, <replace> and <remove> operations, which are applied in
+	order. Each one selects a single node with its sel attribute:
+
+		<diff xmlns:p="urn:example">
+			<add sel="/config/servers"><server name="b" /></add>
+			<add sel="/config/servers/server[@name='a']" type="@port">8080</add>
+			<replace sel="/config/p:timeout/text()">30</replace>
+			<remove sel="/config/servers/server[2]" ws="before" />
+		</diff>
+
+	Selectors are absolute location paths, optionally starting with id('x').
+	Steps are element names, p:* and *, text(), comment(), node() and
+	processing-instruction('target'), followed by predicates; the final
+	step may select an attribute (@name) or namespace declaration
+	(namespace::prefix). Predicates are positions, or comparisons of an
+	attribute, child element, text() or . with a literal. (eg: [2],
+	[@id='x'], [name='y']) Prefixes are resolved in the scope of the
+	operation; as required by the RFC, unprefixed element names are in the
+	default namespace of the patch. Operations are recognized by their local
+	name, so the patch may use any namespace.
+*/
+
+// Apply the operations of the given patch to this document. The patch is the
+// element holding the operations, or the root of a patch document. Either all
+// operations succeed, or the document is left unchanged: they are applied in
+// place, within a transaction which is rolled back if one of them fails. Nodes
+// which are not touched by the patch stay part of the document. Observers see
+// the changes of a failed patch, and their reversal.
+func (this *Document) ApplyPatch(patch *Node) error {
+	if patch.Type == NT_ROOT {
+		if patch = documentElement(patch); patch == nil {
+			return fmt.Errorf("xmlx: patch has no document element")
+		}
+	}
+
+	// The transaction only adds to the history if it was already kept.
+	history := this.history
+	defer func() {
+		if !history {
+			this.history = false
+			this.undo, this.redo = nil, nil
+		}
+	}()
+
+	tx := this.Begin()
+	root := this.Root
+	for _, op := range patch.Children {
+		if op.Type != NT_ELEMENT {
+			continue
+		}
+
+		var err error
+		switch op.Name.Local {
+		case "add":
+			err = patchAdd(root, op)
+		case "replace":
+			err = patchReplace(root, op)
+		case "remove":
+			err = patchRemove(root, op)
+		default:
+			err = fmt.Errorf("xmlx: patch: unknown operation <%s>", op.Name.Local)
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func patchAdd(root, op *Node) error {
+	target, err := locate(root, op)
+	if err != nil {
+		return err
+	}
+	if target.attr != nil {
+		return patchError(op, "can not add to an attribute")
+	}
+
+	if kind := op.As("", "type"); len(kind) > 0 {
+		if target.node.Type != NT_ELEMENT {
+			return patchError(op, "attributes can only be added to elements")
+		}
+		return patchAddAttr(target.node, op, kind)
+	}
+
+	parent, before := target.node, (*Node)(nil)
+	switch pos := op.As("", "pos"); pos {
+	case "":
+	case "prepend":
+		if len(parent.Children) > 0 {
+			before = parent.Children[0]
+		}
+	case "before", "after":
+		if parent = target.node.Parent; parent == nil {
+			return patchError(op, "can not add siblings to the document")
+		}
+		before = target.node
+		if pos == "after" {
+			before = nextSibling(target.node)
+		}
+	default:
+		return patchError(op, fmt.Sprintf("invalid pos %q", pos))
+	}
+
+	if parent.Type != NT_ELEMENT && parent.Type != NT_ROOT {
+		return patchError(op, "can not add children to this node")
+	}
+
+	inscope := inheritedNamespaces(op)
+	for _, v := range op.Children {
+		c := v.Clone()
+		parent.InsertBefore(c, before)
+		declareNamespaces(c, inscope)
+	}
+
+	if parent.Type == NT_ROOT && countElements(parent) > 1 {
+		return patchError(op, "a document can only have one document element")
+	}
+	return nil
+}
+
+func patchAddAttr(n, op *Node, kind string) error {
+	inscope := inheritedNamespaces(op)
+	value := patchText(op)
+
+	if strings.HasPrefix(kind, "namespace::") {
+		prefix := kind[len("namespace::"):]
+		if !isNCName(prefix) {
+			return patchError(op, fmt.Sprintf("invalid type %q", kind))
+		}
+		if n.HasAttr("xmlns", prefix) {
+			return patchError(op, "namespace declaration exists")
+		}
+		n.SetAttrNS("xmlns", prefix, value)
+		return nil
+	}
+
+	if !strings.HasPrefix(kind, "@") {
+		return patchError(op, fmt.Sprintf("invalid type %q", kind))
+	}
+
+	space, local, err := resolveQName(kind[1:], inscope, false)
+	if err != nil {
+		return patchError(op, err.Error())
+	}
+	if n.HasAttr(space, local) {
+		return patchError(op, "attribute exists")
+	}
+
+	n.SetAttrNS(space, local, value)
+	if _, ok := n.lookupPrefix(space, false); len(space) > 0 && !ok {
+		prefix, _ := splitQName(kind[1:])
+		n.SetAttrNS("xmlns", prefix, space)
+	}
+	return nil
+}
+
+func patchReplace(root, op *Node) error {
+	target, err := locate(root, op)
+	if err != nil {
+		return err
+	}
+
+	if target.attr != nil {
+		target.node.setAttrValue(target.attr, patchText(op))
+		return nil
+	}
+
+	n := target.node
+	switch n.Type {
+	case NT_TEXT:
+		n.setValue(patchText(op))
+		return nil
+
+	case NT_ELEMENT, NT_COMMENT, NT_PROCINST:
+		var content *Node
+		for _, v := range op.Children {
+			if isWhitespace(v) {
+				continue
+			}
+			if v.Type != n.Type || content != nil {
+				return patchError(op, "content must be a single node of the replaced type")
+			}
+			content = v
+		}
+		if content == nil {
+			return patchError(op, "missing content")
+		}
+
+		c := content.Clone()
+		n.ReplaceWith(c)
+		declareNamespaces(c, inheritedNamespaces(op))
+		return nil
+	}
+	return patchError(op, "can not replace this node")
+}
+
+func patchRemove(root, op *Node) error {
+	target, err := locate(root, op)
+	if err != nil {
+		return err
+	}
+
+	n := target.node
+	if target.attr != nil {
+		n.RemoveAttrNS(target.attr.Name.Space, target.attr.Name.Local)
+		return nil
+	}
+
+	parent := n.Parent
+	if parent == nil || parent.Type == NT_ROOT && n.Type == NT_ELEMENT {
+		return patchError(op, "can not remove the document element")
+	}
+
+	var remove []*Node
+	switch ws := op.As("", "ws"); ws {
+	case "":
+	case "before", "after", "both":
+		if ws != "after" {
+			remove = append(remove, previousSibling(n))
+		}
+		if ws != "before" {
+			remove = append(remove, nextSibling(n))
+		}
+		for _, v := range remove {
+			if v == nil || !isWhitespace(v) {
+				return patchError(op, "no whitespace to remove")
+			}
+		}
+	default:
+		return patchError(op, fmt.Sprintf("invalid ws %q", ws))
+	}
+
+	for _, v := range append(remove, n) {
+		v.Detach()
+	}
+	return nil
+}
+
+// patchTarget is a node or attribute selected by a patch operation.
+type patchTarget struct {
+	node *Node // The selected node, or the element carrying the attribute.
+	attr *Attr // The selected attribute or namespace declaration, if any.
+}
+
+// locate evaluates the selector of op against the document root, and returns
+// the single node or attribute it matches.
+func locate(root, op *Node) (patchTarget, error) {
+	sel := strings.TrimSpace(op.As("", "sel"))
+	if len(sel) == 0 {
+		return patchTarget{}, patchError(op, "missing sel attribute")
+	}
+
+	list, err := evalSelector(root, sel, inheritedNamespaces(op))
+	if err != nil {
+		return patchTarget{}, patchError(op, err.Error())
+	}
+
+	switch len(list) {
+	case 0:
+		return patchTarget{}, patchError(op, "selector matches nothing")
+	case 1:
+		return list[0], nil
+	}
+	return patchTarget{}, patchError(op, fmt.Sprintf("selector matches %d nodes", len(list)))
+}
+
+// evalSelector returns the nodes and attributes matched by sel.
+func evalSelector(root *Node, sel string, inscope map[string]string) ([]patchTarget, error) {
+	if sel == "/" {
+		return []patchTarget{{node: root}}, nil
+	}
+
+	var set []*Node
+	switch {
+	case strings.HasPrefix(sel, "id("):
+		i := strings.IndexByte(sel, ')')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed selector %q", sel)
+		}
+		id, ok := parseLiteral(strings.TrimSpace(sel[3:i]))
+		if !ok {
+			return nil, fmt.Errorf("malformed selector %q", sel)
+		}
+		if n := selectID(root, id); n != nil {
+			set = append(set, n)
+		}
+		sel = sel[i+1:]
+	case strings.HasPrefix(sel, "/"):
+		set = append(set, root)
+	default:
+		return nil, fmt.Errorf("selector %q is not an absolute path", sel)
+	}
+
+	steps, err := splitSteps(sel)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, step := range steps {
+		last := i == len(steps)-1
+		switch {
+		case strings.HasPrefix(step, "@"):
+			if !last {
+				return nil, fmt.Errorf("attribute step %q must be last", step)
+			}
+			return selectAttrs(set, step[1:], inscope)
+
+		case strings.HasPrefix(step, "namespace::"):
+			if !last {
+				return nil, fmt.Errorf("namespace step %q must be last", step)
+			}
+			return selectNamespaces(set, step[len("namespace::"):])
+		}
+
+		if set, err = selectStep(set, step, inscope); err != nil {
+			return nil, err
+		}
+	}
+
+	list := make([]patchTarget, len(set))
+	for i, n := range set {
+		list[i] = patchTarget{node: n}
+	}
+	return list, nil
+}
+
+// splitSteps splits a path into its location steps. Slashes in predicates and
+// literals do not count.
+func splitSteps(path string) ([]string, error) {
+	var steps []string
+	var quote byte
+	depth, start := 0, 0
+
+	if len(path) == 0 {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return nil, fmt.Errorf("malformed path %q", path)
+	}
+
+	for i := 1; i <= len(path); i++ {
+		if i < len(path) {
+			switch c := path[i]; {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '\'' || c == '"':
+				quote = c
+				continue
+			case c == '[':
+				depth++
+				continue
+			case c == ']':
+				depth--
+				continue
+			case c != '/' || depth > 0:
+				continue
+			}
+		}
+
+		step := strings.TrimSpace(path[start+1 : i])
+		if len(step) == 0 {
+			return nil, fmt.Errorf("empty step in %q", path)
+		}
+		steps = append(steps, step)
+		start = i
+	}
+
+	if quote != 0 || depth != 0 {
+		return nil, fmt.Errorf("malformed path %q", path)
+	}
+	return steps, nil
+}
+
+// selectStep returns the children of the nodes in set matching step.
+func selectStep(set []*Node, step string, inscope map[string]string) ([]*Node, error) {
+	test, preds, err := splitPredicates(step)
+	if err != nil {
+		return nil, err
+	}
+
+	match, err := nodeTest(strings.TrimPrefix(test, "child::"), inscope)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*Node
+	for _, n := range set {
+		var list []*Node
+		for _, v := range n.Children {
+			if match(v) {
+				list = append(list, v)
+			}
+		}
+
+		for _, p := range preds {
+			if list, err = filterNodes(list, p, inscope); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, list...)
+	}
+	return res, nil
+}
+
+// splitPredicates separates the node test of a step from its predicates.
+func splitPredicates(step string) (string, []string, error) {
+	i := strings.IndexByte(step, '[')
+	if i < 0 {
+		return step, nil, nil
+	}
+
+	test, rest := strings.TrimSpace(step[:i]), step[i:]
+	var preds []string
+	for len(rest) > 0 {
+		if rest[0] != '[' {
+			return "", nil, fmt.Errorf("malformed step %q", step)
+		}
+
+		var quote byte
+		end := -1
+		for j := 1; j < len(rest) && end < 0; j++ {
+			switch c := rest[j]; {
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"':
+				quote = c
+			case c == ']':
+				end = j
+			}
+		}
+
+		if end < 0 {
+			return "", nil, fmt.Errorf("malformed step %q", step)
+		}
+		preds = append(preds, strings.TrimSpace(rest[1:end]))
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+	return test, preds, nil
+}
+
+// nodeTest returns a function matching the nodes selected by the given test.
+func nodeTest(test string, inscope map[string]string) (func(*Node) bool, error) {
+	switch test {
+	case "node()":
+		return func(n *Node) bool { return n.Type != NT_DIRECTIVE }, nil
+	case "text()":
+		return func(n *Node) bool { return n.Type == NT_TEXT }, nil
+	case "comment()":
+		return func(n *Node) bool { return n.Type == NT_COMMENT }, nil
+	case "*":
+		return func(n *Node) bool { return n.Type == NT_ELEMENT }, nil
+	}
+
+	if strings.HasPrefix(test, "processing-instruction(") && strings.HasSuffix(test, ")") {
+		arg := strings.TrimSpace(test[len("processing-instruction(") : len(test)-1])
+		if len(arg) == 0 {
+			return func(n *Node) bool { return n.Type == NT_PROCINST }, nil
+		}
+		target, ok := parseLiteral(arg)
+		if !ok {
+			return nil, fmt.Errorf("malformed node test %q", test)
+		}
+		return func(n *Node) bool { return n.Type == NT_PROCINST && n.Target == target }, nil
+	}
+
+	if strings.HasSuffix(test, ":*") {
+		space, ok := inscope[test[:len(test)-2]]
+		if !ok {
+			return nil, fmt.Errorf("undeclared prefix in %q", test)
+		}
+		return func(n *Node) bool { return n.Type == NT_ELEMENT && n.Name.Space == space }, nil
+	}
+
+	space, local, err := resolveQName(test, inscope, true)
+	if err != nil {
+		return nil, err
+	}
+	return func(n *Node) bool {
+		return n.Type == NT_ELEMENT && n.Name.Local == local && n.Name.Space == space
+	}, nil
+}
+
+// filterNodes returns the nodes in list for which the predicate holds.
+func filterNodes(list []*Node, pred string, inscope map[string]string) ([]*Node, error) {
+	if idx, err := strconv.Atoi(pred); err == nil {
+		if idx < 1 || idx > len(list) {
+			return nil, nil
+		}
+		return list[idx-1 : idx], nil
+	}
+
+	i := strings.IndexByte(pred, '=')
+	if i < 0 {
+		return nil, fmt.Errorf("unsupported predicate %q", pred)
+	}
+
+	lhs := strings.TrimSpace(pred[:i])
+	value, ok := parseLiteral(strings.TrimSpace(pred[i+1:]))
+	if !ok {
+		return nil, fmt.Errorf("unsupported predicate %q", pred)
+	}
+
+	var test func(*Node) bool
+	switch {
+	case lhs == ".":
+		test = func(n *Node) bool { return n.TextContent() == value }
+
+	case strings.HasPrefix(lhs, "@"):
+		space, local, err := resolveQName(lhs[1:], inscope, false)
+		if err != nil {
+			return nil, err
+		}
+		test = func(n *Node) bool { return n.HasAttr(space, local) && n.As(space, local) == value }
+
+	default:
+		match, err := nodeTest(lhs, inscope)
+		if err != nil {
+			return nil, err
+		}
+		test = func(n *Node) bool {
+			for _, v := range n.Children {
+				if match(v) && v.TextContent() == value {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	var res []*Node
+	for _, n := range list {
+		if test(n) {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+// selectAttrs returns the attributes of the elements in set matching name,
+// which may be *. Namespace declarations are not included.
+func selectAttrs(set []*Node, name string, inscope map[string]string) ([]patchTarget, error) {
+	var space, local string
+	if name != "*" {
+		var err error
+		if space, local, err = resolveQName(name, inscope, false); err != nil {
+			return nil, err
+		}
+	}
+
+	var res []patchTarget
+	for _, n := range set {
+		for _, a := range n.Attributes {
+			if isNamespaceDecl(a) || name != "*" && (a.Name.Space != space || a.Name.Local != local) {
+				continue
+			}
+			res = append(res, patchTarget{node: n, attr: a})
+		}
+	}
+	return res, nil
+}
+
+// selectNamespaces returns the namespace declarations of the elements in set
+// for the given prefix. The default namespace is selected with a name()
+// predicate comparing to the empty string.
+func selectNamespaces(set []*Node, step string) ([]patchTarget, error) {
+	prefix := step
+	if strings.HasPrefix(step, "*") {
+		test, preds, err := splitPredicates(step)
+		if err != nil || test != "*" || len(preds) != 1 || !strings.HasPrefix(preds[0], "name()") {
+			return nil, fmt.Errorf("unsupported namespace step %q", step)
+		}
+
+		var ok bool
+		rhs := strings.TrimLeft(preds[0][len("name()"):], " ")
+		if !strings.HasPrefix(rhs, "=") {
+			return nil, fmt.Errorf("unsupported namespace step %q", step)
+		}
+		if prefix, ok = parseLiteral(strings.TrimSpace(rhs[1:])); !ok {
+			return nil, fmt.Errorf("unsupported namespace step %q", step)
+		}
+	}
+
+	var res []patchTarget
+	for _, n := range set {
+		for _, a := range n.Attributes {
+			if a.Name.Space == "xmlns" && a.Name.Local == prefix || len(prefix) == 0 && len(a.Name.Space) == 0 && a.Name.Local == "xmlns" {
+				res = append(res, patchTarget{node: n, attr: a})
+			}
+		}
+	}
+	return res, nil
+}
+
+// resolveQName returns the namespace and local part of a qualified name.
+// If def is set, unprefixed names are in the default namespace.
+func resolveQName(name string, inscope map[string]string, def bool) (space, local string, err error) {
+	prefix, local := splitQName(name)
+	if !isNCName(local) || len(prefix) > 0 && !isNCName(prefix) {
+		return "", "", fmt.Errorf("invalid name %q", name)
+	}
+
+	switch {
+	case len(prefix) == 0 && def:
+		return inscope[""], local, nil
+	case len(prefix) == 0:
+		return "", local, nil
+	case prefix == "xml":
+		return nsXML, local, nil
+	}
+
+	space, ok := inscope[prefix]
+	if !ok {
+		return "", "", fmt.Errorf("undeclared prefix in %q", name)
+	}
+	return space, local, nil
+}
+
+// parseLiteral returns the content of a quoted string.
+func parseLiteral(s string) (string, bool) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || s[0] != '\'' && s[0] != '"' {
+		return "", false
+	}
+	return s[1 : len(s)-1], true
+}
+
+// declareNamespaces adds declarations to n, which was copied from a patch, for
+// the namespaces it uses that are not in scope at its new position. inscope
+// holds the namespaces in scope for the operation it was taken from.
+func declareNamespaces(n *Node, inscope map[string]string) {
+	if n.Type != NT_ELEMENT {
+		return
+	}
+
+	used := make(map[string]bool)
+	var walk func(*Node)
+	walk = func(c *Node) {
+		if len(c.Name.Space) > 0 {
+			used[c.Name.Space] = true
+		}
+		for _, a := range c.Attributes {
+			if !isNamespaceDecl(a) && len(a.Name.Space) > 0 {
+				used[a.Name.Space] = true
+			}
+		}
+		for _, v := range c.Children {
+			if v.Type == NT_ELEMENT {
+				walk(v)
+			}
+		}
+	}
+	walk(n)
+
+	for prefix, space := range inscope {
+		if !used[space] || space == nsXML {
+			continue
+		}
+		if _, ok := n.lookupPrefix(space, true); ok {
+			continue
+		}
+
+		if len(prefix) == 0 {
+			n.Attributes = append(n.Attributes, &Attr{Name: xml.Name{Space: "", Local: "xmlns"}, Value: space})
+		} else {
+			n.Attributes = append(n.Attributes, &Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: space})
+		}
+	}
+
+	// Keep unqualified names out of a default namespace at the new position.
+	if len(n.Name.Space) == 0 && n.Parent != nil {
+		if space, ok := inheritedNamespaces(n.Parent)[""]; ok && len(space) > 0 && !n.HasAttr("", "xmlns") {
+			n.Attributes = append(n.Attributes, &Attr{Name: xml.Name{Space: "", Local: "xmlns"}})
+		}
+	}
+}
+
+// patchText returns the text content of a patch operation.
+func patchText(op *Node) string {
+	var s string
+	for _, v := range op.Children {
+		if v.Type == NT_TEXT {
+			s += v.Value
+		}
+	}
+	return s + op.Value
+}
+
+func patchError(op *Node, msg string) error {
+	return fmt.Errorf("xmlx: patch <%s sel=%q>: %s", op.Name.Local, op.As("", "sel"), msg)
+}
+
+func previousSibling(n *Node) *Node {
+	list := n.Parent.Children
+	if i := indexOf(list, n); i > 0 {
+		return list[i-1]
+	}
+	return nil
+}
+
+func nextSibling(n *Node) *Node {
+	list := n.Parent.Children
+	if i := indexOf(list, n); i >= 0 && i+1 < len(list) {
+		return list[i+1]
+	}
+	return nil
+}
+
+// documentElement returns the first child element of n.
+func documentElement(n *Node) *Node {
+	for _, v := range n.Children {
+		if v.Type == NT_ELEMENT {
+			return v
+		}
+	}
+	return nil
+}
+
+func countElements(n *Node) int {
+	count := 0
+	for _, v := range n.Children {
+		if v.Type == NT_ELEMENT {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns a patch document with the operations which turn document a into b.
+// It is built from the changes reported by Diff: inserts become <add>,
+// deletes <remove> and updates <replace> operations; moved nodes are removed
+// and added again. Attribute order and the default namespace declaration can
+// not be expressed in a patch, so changes to them are left out. Prefixes
+// used in selectors are declared on the patch element, which assumes both
+// documents bind them consistently.
+func MakePatch(a, b *Document, opts DiffOptions) *Document {
+	patch := NewNode(NT_ELEMENT)
+	patch.Name.Local = "diff"
+	declarePatchNamespaces(patch, a.Root, b.Root)
+
+	changes := Diff(a.Root, b.Root, opts)
+	for i := 0; i < len(changes); i++ {
+		c := changes[i]
+		if c.Attr != nil && (c.Type == CH_MOVE || c.Attr.Name.Space == "" && c.Attr.Name.Local == "xmlns") {
+			continue
+		}
+
+		switch c.Type {
+		case CH_INSERT:
+			if c.Attr != nil {
+				parent, step := splitPath(c.Path)
+				op := patchOp(patch, "add", parent)
+				op.SetAttr("type", step)
+				addText(op, c.New)
+				continue
+			}
+			addPatchNode(patch, c)
+
+		case CH_DELETE:
+			patchOp(patch, "remove", c.Path)
+
+		case CH_UPDATE:
+			op := patchOp(patch, "replace", c.Path)
+			switch {
+			case c.Attr != nil, c.Node.Type == NT_TEXT:
+				addText(op, c.New)
+			case c.Node.Type == NT_ELEMENT:
+				// The value of an element can not be selected on its own;
+				// replace the element, including the changes below it.
+				op.AddChild(c.Node.Clone())
+				for i+1 < len(changes) && strings.HasPrefix(changes[i+1].Path, c.Path+"/") {
+					i++
+				}
+			default:
+				op.AddChild(c.Node.Clone())
+			}
+
+		case CH_MOVE:
+			patchOp(patch, "remove", c.From)
+			addPatchNode(patch, c)
+		}
+	}
+
+	return NewDocumentWithRoot(patch)
+}
+
+// addPatchNode adds the operation inserting the node of change c.
+func addPatchNode(patch *Node, c Change) {
+	var op *Node
+	switch {
+	case len(c.Before) > 0:
+		op = patchOp(patch, "add", c.Before)
+		op.SetAttr("pos", "before")
+	case len(c.Parent) > 0:
+		op = patchOp(patch, "add", c.Parent)
+	default:
+		op = patchOp(patch, "add", "/")
+	}
+	op.AddChild(c.Node.Clone())
+}
+
+func patchOp(patch *Node, name, sel string) *Node {
+	op := NewNode(NT_ELEMENT)
+	op.Name.Local = name
+	op.SetAttr("sel", sel)
+	patch.AddChild(op)
+	return op
+}
+
+func addText(n *Node, s string) {
+	if len(s) == 0 {
+		return
+	}
+	t := NewNode(NT_TEXT)
+	t.Value = s
+	n.AddChild(t)
+}
+
+// splitPath separates the last step from a path.
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	return path[:i], path[i+1:]
+}
+
+// declarePatchNamespaces declares the prefixes used in the given documents on
+// the patch element. If the document element of the first one is in a
+// default namespace, the patch uses it as well, so unprefixed names in
+// selectors resolve to it.
+func declarePatchNamespaces(patch *Node, roots ...*Node) {
+	seen := make(map[string]bool)
+	var walk func(*Node)
+	walk = func(n *Node) {
+		for _, a := range n.Attributes {
+			if a.Name.Space == "xmlns" && !seen[a.Name.Local] {
+				seen[a.Name.Local] = true
+				patch.Attributes = append(patch.Attributes, &Attr{Name: a.Name, Value: a.Value})
+			}
+		}
+		for _, v := range n.Children {
+			if v.Type == NT_ELEMENT {
+				walk(v)
+			}
+		}
+	}
+
+	for _, root := range roots {
+		walk(root)
+	}
+
+	if n := documentElement(roots[0]); n != nil && len(n.Name.Space) > 0 && len(elementPrefix(n)) == 0 {
+		patch.Attributes = append(patch.Attributes, &Attr{Name: xml.Name{Space: "", Local: "xmlns"}, Value: n.Name.Space})
+	}
+}
@@ -0,0 +1,753 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Ways to write elements without content. See SaveOptions.SelfClose.
+const (
+	SC_SPACE   = iota // <a />
+	SC_COMPACT        // <a/>
+	SC_NEVER          // <a></a>
+)
+
+// SaveOptions controls the output of Document.SaveWith. The zero value writes
+// the document without adding any formatting.
+type SaveOptions struct {
+	Indent       string // Indentation for a single level. Enables pretty printing.
+	NewLine      string // Line separator used for pretty printing. Defaults to "\n" if Indent is set.
+	MaxLineWidth int    // Wrap attributes onto new lines once a start tag exceeds this width.
+	SelfClose    byte   // How to write empty elements. One of the SC_* constants.
+	QuoteChar    byte   // Attribute quote character; '"' (the default) or '\''.
+	SortAttrs    bool   // Write attributes sorted by name, namespace declarations first.
+	Strict       bool   // Guarantee well-formed output. See Document.SaveWith.
+	Minify       bool   // Write the smallest equivalent output. See Document.SaveWith.
+	KeepComments bool   // Keep comments when minifying.
+}
+
+// Save the contents of this document to the supplied writer, formatted
+// according to the given options.
+//
+// When pretty printing, each element with element-only content (child
+// elements, comments and processing instructions, separated by whitespace at
+// most) is written with its children on separate, indented lines. The
+// whitespace between them is replaced. Mixed content and the content of
+// elements with xml:space="preserve" is written as is.
+//
+// In strict mode, the document is checked before anything is written. If it
+// can not be represented as well-formed XML, an error is returned. This is the
+// case for names which are not valid XML names, illegal characters, comments
+// containing "--", processing instructions containing "?>", duplicate
+// attributes and documents without exactly one root element. All text and
+// attribute values are escaped, including newlines and tabs in attributes, so
+// they survive a reload unchanged.
+//
+// The output is encoded in the charset named by Document.Encoding, which may
+// be UTF-8, UTF-16 (with a byte order mark), UTF-16BE, UTF-16LE, ISO-8859-1,
+// Windows-1252 or US-ASCII. Characters in text and attribute values which the
+// charset can not represent are written as numeric character references.
+// Elsewhere, eg: in names and comments, they cause an error. Documents in any
+// other charset are written as UTF-8, declared as such, unless Strict is set;
+// then the save fails.
+//
+// Minifying removes whitespace between child elements of element-only
+// content, comments unless KeepComments is set, and namespace declarations
+// repeating a binding already in scope. Empty elements are written as <a/>,
+// and only the characters which require it are escaped, choosing the quote
+// character needing the least escaping for each attribute. The content of
+// elements with xml:space="preserve" is left alone. Indentation options are
+// ignored.
+func (this *Document) SaveWith(w io.Writer, opts SaveOptions) error {
+	return this.save(w, opts, false)
+}
+
+// Save the contents of this document as a byte slice, formatted according to
+// the given options. See Document.SaveWith.
+func (this *Document) SaveBytesWith(opts SaveOptions) ([]byte, error) {
+	var b bytes.Buffer
+	if err := this.SaveWith(&b, opts); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// save writes the document to w, encoded as specified by Document.Encoding.
+// The xml declaration is followed by a newline when pretty printing, or if
+// newline is set.
+func (this *Document) save(w io.Writer, opts SaveOptions, newline bool) error {
+	if !opts.Strict {
+		return this.write(w, opts, newline)
+	}
+
+	if err := this.checkDocument(); err != nil {
+		return err
+	}
+
+	// Names which the charset can not represent are only found while
+	// writing, so the output is held back until it is complete.
+	var b bytes.Buffer
+	if err := this.write(&b, opts, newline); err != nil {
+		return err
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// write does the work for save, once the document was checked.
+func (this *Document) write(w io.Writer, opts SaveOptions, newline bool) error {
+	encoding := this.Encoding
+	cs, err := lookupCharset(encoding)
+	if err != nil {
+		if opts.Strict {
+			return err
+		}
+		encoding = "UTF-8"
+	}
+
+	var enc *encoder
+	if cs != nil {
+		enc = &encoder{w: w, cs: cs}
+		w = enc
+	}
+
+	p := newPrinter(w, opts)
+	p.cs = cs
+
+	if this.SaveDocType {
+		p.declaration(this, encoding)
+
+		if p.pretty {
+			p.WriteString(p.opts.NewLine)
+		} else if newline {
+			p.WriteByte('\n')
+		}
+	}
+
+	p.declareMissing(this.Root, this.PreferredPrefixes)
+	p.root(this.Root)
+	if err = p.Flush(); err != nil || enc == nil {
+		return err
+	}
+	return enc.close()
+}
+
+// declaration writes the xml declaration of doc, naming the given encoding.
+func (this *printer) declaration(doc *Document, encoding string) {
+	if !this.opts.Strict && !this.opts.Minify {
+		fmt.Fprintf(this, `<?xml version="%s" encoding="%s" standalone="%s"?>`,
+			doc.Version, encoding, doc.StandAlone)
+		return
+	}
+
+	// Empty values are not allowed, so leave those out.
+	fmt.Fprintf(this, `<?xml version="%s"`, doc.Version)
+	if len(encoding) > 0 {
+		fmt.Fprintf(this, ` encoding="%s"`, encoding)
+	}
+	if len(doc.StandAlone) > 0 {
+		fmt.Fprintf(this, ` standalone="%s"`, doc.StandAlone)
+	}
+	this.WriteString("?>")
+}
+
+// printer serializes nodes to a buffered writer. Write errors are sticky in
+// bufio.Writer, so they only need to be checked once, by the final Flush.
+type printer struct {
+	*bufio.Writer
+	opts    SaveOptions
+	cs      *charset // Output charset, nil for utf-8.
+	pretty  bool
+	scratch []byte
+
+	generated map[string]string // Prefixes for namespaces without one in scope, by uri.
+	decls     map[*Node][]*Attr // Declarations of generated prefixes, by element.
+}
+
+func newPrinter(w io.Writer, opts SaveOptions) *printer {
+	p := &printer{Writer: bufio.NewWriter(w), opts: opts}
+	p.pretty = !opts.Minify && (len(opts.Indent) > 0 || len(opts.NewLine) > 0)
+	if opts.Minify {
+		p.opts.SelfClose = SC_COMPACT
+	}
+	if p.pretty && len(opts.NewLine) == 0 {
+		p.opts.NewLine = "\n"
+	}
+	if p.opts.QuoteChar != '\'' {
+		p.opts.QuoteChar = '"'
+	}
+	return p
+}
+
+// node writes n and its descendants. Pretty printing or minifying applies to
+// n's content only if pretty is set.
+func (this *printer) node(n *Node, depth int, pretty bool) {
+	switch n.Type {
+	case NT_PROCINST:
+		this.WriteString("<?")
+		this.WriteString(n.Target)
+		if !this.opts.Minify || len(n.Value) > 0 {
+			this.WriteByte(' ')
+		}
+		this.WriteString(n.Value)
+		this.WriteString("?>")
+	case NT_COMMENT:
+		if !this.opts.Minify {
+			this.WriteString("<!-- ")
+			this.WriteString(n.Value)
+			this.WriteString(" -->")
+		} else if this.opts.KeepComments {
+			this.WriteString("<!--")
+			this.WriteString(n.Value)
+			this.WriteString("-->")
+		}
+	case NT_DIRECTIVE:
+		this.WriteString("<!")
+		this.WriteString(n.Value)
+		this.WriteByte('>')
+	case NT_ELEMENT:
+		this.element(n, depth, pretty)
+	case NT_TEXT:
+		this.text(n)
+	case NT_ROOT:
+		this.root(n)
+	}
+}
+
+func (this *printer) root(n *Node) {
+	if !this.pretty {
+		for _, v := range n.Children {
+			if this.opts.Minify && isWhitespace(v) {
+				continue
+			}
+			this.node(v, 0, this.opts.Minify)
+		}
+		return
+	}
+
+	first := true
+	for _, v := range n.Children {
+		if isWhitespace(v) {
+			continue
+		}
+		if !first {
+			this.WriteString(this.opts.NewLine)
+		}
+		this.node(v, 0, true)
+		first = false
+	}
+	this.WriteString(this.opts.NewLine)
+}
+
+func (this *printer) text(n *Node) {
+	if this.opts.Minify {
+		this.escapeMinimal(n.Value)
+		return
+	}
+	if this.opts.Strict {
+		this.escapeStrict(n.Value)
+		return
+	}
+	this.escapeText(n.Value, n.Parent != nil && len(n.Parent.Children) > 1)
+}
+
+func (this *printer) element(n *Node, depth int, pretty bool) {
+	switch n.As(nsXML, "space") {
+	case "preserve":
+		pretty = false
+	case "default":
+		// Minifying resumes inside preserved content; indenting does not,
+		// since the parent's whitespace was kept.
+		pretty = pretty || this.opts.Minify
+	}
+
+	prefix := this.prefix(n, n.Name.Space, true)
+	this.startTag(n, prefix, depth, pretty && this.pretty)
+
+	indent := pretty && isElementOnly(n)
+
+	var children []*Node
+	if indent {
+		for _, v := range n.Children {
+			if !isWhitespace(v) {
+				children = append(children, v)
+			}
+		}
+	} else {
+		children = n.Children
+	}
+
+	if len(children) == 0 && len(n.Value) == 0 {
+		switch this.opts.SelfClose {
+		case SC_COMPACT:
+			this.WriteString("/>")
+			return
+		case SC_NEVER:
+			this.WriteByte('>')
+			this.endTag(n, prefix)
+			return
+		}
+		this.WriteString(" />")
+		return
+	}
+
+	this.WriteByte('>')
+
+	// When minifying, whitespace stays insignificant in mixed content.
+	inner := indent
+	if this.opts.Minify {
+		inner = pretty
+	}
+
+	for _, v := range children {
+		if indent && this.pretty {
+			this.newLine(depth + 1)
+		}
+		this.node(v, depth+1, inner)
+	}
+
+	if indent && this.pretty {
+		this.newLine(depth)
+	}
+
+	if this.opts.Minify {
+		this.escapeMinimal(n.Value)
+	} else if this.opts.Strict {
+		this.escapeStrict(n.Value)
+	} else {
+		this.escapeText(n.Value, false)
+	}
+	this.endTag(n, prefix)
+}
+
+// startTag writes the start tag of n, without the closing '>'.
+func (this *printer) startTag(n *Node, prefix string, depth int, pretty bool) {
+	this.WriteByte('<')
+	this.name(prefix, n.Name.Local)
+
+	attrs := n.Attributes
+	if extra := this.decls[n]; len(extra) > 0 {
+		attrs = append(attrs[:len(attrs):len(attrs)], extra...)
+	}
+	if this.opts.SortAttrs {
+		attrs = sortedAttrs(attrs)
+	}
+
+	if !pretty || this.opts.MaxLineWidth <= 0 {
+		for _, v := range attrs {
+			if this.opts.Minify && isRedundantDecl(n, v) {
+				continue
+			}
+			this.WriteString(this.attr(n, v))
+		}
+		return
+	}
+
+	// Pretty printed start tags always begin on a fresh, indented line.
+	indent := utf8.RuneCountInString(this.opts.Indent)
+	col := indent*depth + 1 + utf8.RuneCountInString(n.Name.Local)
+	if len(prefix) > 0 {
+		col += utf8.RuneCountInString(prefix) + 1
+	}
+
+	for i, v := range attrs {
+		a := this.attr(n, v)
+		if size := utf8.RuneCountInString(a); i == 0 || col+size <= this.opts.MaxLineWidth {
+			this.WriteString(a)
+			col += size
+			continue
+		}
+
+		this.newLine(depth + 1)
+		this.WriteString(a[1:])
+		col = indent*(depth+1) + utf8.RuneCountInString(a) - 1
+	}
+}
+
+func (this *printer) endTag(n *Node, prefix string) {
+	this.WriteString("</")
+	this.name(prefix, n.Name.Local)
+	this.WriteByte('>')
+}
+
+func (this *printer) name(prefix, local string) {
+	if len(prefix) > 0 {
+		this.WriteString(prefix)
+		this.WriteByte(':')
+	}
+	this.WriteString(local)
+}
+
+// attr returns the attribute a of node n, including a leading space.
+func (this *printer) attr(n *Node, a *Attr) string {
+	var b strings.Builder
+	b.WriteByte(' ')
+	if len(a.Name.Space) > 0 {
+		b.WriteString(this.prefix(n, a.Name.Space, false))
+		b.WriteByte(':')
+	}
+	b.WriteString(a.Name.Local)
+	b.WriteByte('=')
+
+	quote := this.opts.QuoteChar
+	if this.opts.Minify {
+		quote = '"'
+		if strings.IndexByte(a.Value, '"') > -1 && strings.IndexByte(a.Value, '\'') < 0 {
+			quote = '\''
+		}
+	}
+	b.WriteByte(quote)
+
+	last := 0
+	for i := 0; i < len(a.Value); i++ {
+		var esc string
+		switch a.Value[i] {
+		case '&':
+			esc = "&amp;"
+		case '<':
+			esc = "&lt;"
+		case '"':
+			if quote != '"' {
+				continue
+			}
+			esc = "&quot;"
+		case '\'':
+			if quote != '\'' {
+				continue
+			}
+			esc = "&apos;"
+		case '\t', '\n', '\r':
+			// Would be normalized to spaces when read back.
+			if !this.opts.Strict && !this.opts.Minify {
+				continue
+			}
+			esc = fmt.Sprintf("&#x%X;", a.Value[i])
+		default:
+			continue
+		}
+		b.WriteString(this.cs.refs(a.Value[last:i]))
+		b.WriteString(esc)
+		last = i + 1
+	}
+
+	b.WriteString(this.cs.refs(a.Value[last:]))
+	b.WriteByte(quote)
+	return b.String()
+}
+
+// escapeText writes s with markup characters and carriage returns escaped.
+// Newlines and tabs are escaped as well, unless keepSpace is set; mixed
+// content keeps them, so its layout stays as it is. Characters which are not
+// allowed in XML are replaced by U+FFFD.
+func (this *printer) escapeText(s string, keepSpace bool) {
+	last := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+
+		var esc string
+		switch {
+		case r == '&':
+			esc = "&amp;"
+		case r == '<':
+			esc = "&lt;"
+		case r == '>':
+			esc = "&gt;"
+		case r == '\r':
+			esc = "&#xD;"
+		case r == '\n' && !keepSpace:
+			esc = "&#xA;"
+		case r == '\t' && !keepSpace:
+			esc = "&#x9;"
+		case !isChar(r) || r == utf8.RuneError && size == 1:
+			esc = this.cs.refs("\uFFFD")
+		default:
+			i += size
+			continue
+		}
+
+		this.WriteString(this.cs.refs(s[last:i]))
+		this.WriteString(esc)
+		i += size
+		last = i
+	}
+	this.WriteString(this.cs.refs(s[last:]))
+}
+
+// escapeStrict writes s with all markup characters escaped. Carriage returns
+// are escaped too, since they would be turned into newlines when read back.
+func (this *printer) escapeStrict(s string) {
+	last := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case '&':
+			esc = "&amp;"
+		case '<':
+			esc = "&lt;"
+		case '>':
+			esc = "&gt;"
+		case '\r':
+			esc = "&#xD;"
+		default:
+			continue
+		}
+		this.WriteString(this.cs.refs(s[last:i]))
+		this.WriteString(esc)
+		last = i + 1
+	}
+	this.WriteString(this.cs.refs(s[last:]))
+}
+
+// escapeMinimal writes s with only the escapes required to read it back
+// unchanged: '&', '<', '>' following "]]" and carriage returns.
+func (this *printer) escapeMinimal(s string) {
+	last := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case '&':
+			esc = "&amp;"
+		case '<':
+			esc = "&lt;"
+		case '>':
+			if i < 2 || s[i-2:i] != "]]" {
+				continue
+			}
+			esc = "&gt;"
+		case '\r':
+			esc = "&#xD;"
+		default:
+			continue
+		}
+		this.WriteString(this.cs.refs(s[last:i]))
+		this.WriteString(esc)
+		last = i + 1
+	}
+	this.WriteString(this.cs.refs(s[last:]))
+}
+
+func (this *printer) newLine(depth int) {
+	this.WriteString(this.opts.NewLine)
+	for i := 0; i < depth; i++ {
+		this.WriteString(this.opts.Indent)
+	}
+}
+
+// prefix returns the prefix to write for the given namespace on element n.
+// If def is set, the default namespace counts as well. See declareMissing.
+func (this *printer) prefix(n *Node, space string, def bool) string {
+	if len(space) == 0 {
+		return ""
+	}
+	if prefix, ok := n.lookupPrefix(space, def); ok {
+		return prefix
+	}
+	if prefix, ok := this.generated[space]; ok {
+		return prefix
+	}
+	return space
+}
+
+// declareMissing finds the namespaces used in the tree at n which have no
+// prefix in scope, so the output stays namespace-well-formed. Each of them is
+// declared on the innermost element holding all its uses, with the prefix
+// from preferred if that is not in use yet, or a generated one otherwise.
+// (ns1, ns2, ...) The tree itself is left alone.
+//
+// A namespace which is a valid prefix by itself is written as such, as it
+// is by Canonicalize; documents parsed from a source lacking the declaration
+// hold the prefix in place of the uri.
+func (this *printer) declareMissing(n *Node, preferred map[string]string) {
+	var order []string
+	uses := make(map[string][]*Node)
+	taken := make(map[string]bool)
+
+	use := func(v *Node, space string, def bool) {
+		if len(space) == 0 {
+			return
+		}
+		if _, ok := v.lookupPrefix(space, def); ok {
+			return
+		}
+		if isNCName(space) {
+			taken[space] = true
+			return
+		}
+		if list := uses[space]; len(list) == 0 || list[len(list)-1] != v {
+			if len(list) == 0 {
+				order = append(order, space)
+			}
+			uses[space] = append(list, v)
+		}
+	}
+
+	for v := n.Parent; v != nil; v = v.Parent {
+		for _, a := range v.Attributes {
+			if a.Name.Space == "xmlns" {
+				taken[a.Name.Local] = true
+			}
+		}
+	}
+
+	var walk func(v *Node)
+	walk = func(v *Node) {
+		if v.Type == NT_ELEMENT {
+			use(v, v.Name.Space, true)
+			for _, a := range v.Attributes {
+				if a.Name.Space == "xmlns" {
+					taken[a.Name.Local] = true
+				} else if !isNamespaceDecl(a) {
+					use(v, a.Name.Space, false)
+				}
+			}
+		}
+		for _, c := range v.Children {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	if len(order) == 0 {
+		return
+	}
+
+	this.generated = make(map[string]string, len(order))
+	this.decls = make(map[*Node][]*Attr)
+
+	for _, space := range order {
+		prefix := preferred[space]
+		if !isNCName(prefix) || taken[prefix] || strings.HasPrefix(strings.ToLower(prefix), "xml") {
+			prefix = ""
+			for i := 1; len(prefix) == 0; i++ {
+				if !taken["ns"+strconv.Itoa(i)] {
+					prefix = "ns" + strconv.Itoa(i)
+				}
+			}
+		}
+		taken[prefix] = true
+		this.generated[space] = prefix
+
+		decl := &Attr{Name: xml.Name{Space: "xmlns", Local: prefix}, Value: space}
+		list := uses[space]
+		if at := commonAncestor(list); at != nil && at.Type == NT_ELEMENT {
+			list = []*Node{at}
+		}
+		for _, v := range list {
+			this.decls[v] = append(this.decls[v], decl)
+		}
+	}
+}
+
+// commonAncestor returns the innermost node holding all of the given nodes,
+// or nil if they are not in the same tree.
+func commonAncestor(list []*Node) *Node {
+	depth := func(n *Node) (d int) {
+		for ; n.Parent != nil; n = n.Parent {
+			d++
+		}
+		return
+	}
+
+	at := list[0]
+	for _, v := range list[1:] {
+		da, dv := depth(at), depth(v)
+		for ; da > dv; da-- {
+			at = at.Parent
+		}
+		for ; dv > da; dv-- {
+			v = v.Parent
+		}
+		for at != v {
+			at, v = at.Parent, v.Parent
+		}
+		if at == nil {
+			return nil
+		}
+	}
+	return at
+}
+
+// elementPrefix returns the prefix for the name of element n. This is the
+// prefix bound to its namespace, or the namespace itself if it has none.
+func elementPrefix(n *Node) string {
+	if len(n.Name.Space) == 0 {
+		return ""
+	}
+	if prefix, ok := n.lookupPrefix(n.Name.Space, true); ok {
+		return prefix
+	}
+	return n.Name.Space
+}
+
+// isElementOnly returns true if n has child nodes other than text, and all
+// of its text children consist of whitespace only.
+func isElementOnly(n *Node) bool {
+	if len(n.Value) > 0 {
+		return false
+	}
+
+	elements := false
+	for _, v := range n.Children {
+		if v.Type != NT_TEXT {
+			elements = true
+		} else if !isWhitespace(v) {
+			return false
+		}
+	}
+	return elements
+}
+
+func isWhitespace(n *Node) bool {
+	return n.Type == NT_TEXT && len(strings.TrimLeft(n.Value, " \t\r\n")) == 0
+}
+
+// sortedAttrs returns a sorted copy of the given attribute list. Namespace
+// declarations come first, the rest is sorted by namespace and name.
+func sortedAttrs(list []*Attr) []*Attr {
+	attrs := append([]*Attr(nil), list...)
+	sort.SliceStable(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if na, nb := isNamespaceDecl(a), isNamespaceDecl(b); na != nb {
+			return na
+		}
+		if a.Name.Space != b.Name.Space {
+			return a.Name.Space < b.Name.Space
+		}
+		return a.Name.Local < b.Name.Local
+	})
+	return attrs
+}
+
+// isRedundantDecl returns true if a is a namespace declaration on n which
+// repeats a binding already in scope for its parent.
+func isRedundantDecl(n *Node, a *Attr) bool {
+	if !isNamespaceDecl(a) {
+		return false
+	}
+
+	prefix := ""
+	if a.Name.Space == "xmlns" {
+		prefix = a.Name.Local
+	}
+
+	uri, ok := inheritedNamespaces(n.Parent)[prefix]
+	if !ok {
+		return len(prefix) == 0 && len(a.Value) == 0
+	}
+	return uri == a.Value
+}
+
+func isNamespaceDecl(a *Attr) bool {
+	return a.Name.Space == "xmlns" || (len(a.Name.Space) == 0 && a.Name.Local == "xmlns")
+}
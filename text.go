@@ -0,0 +1,119 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import "strings"
+
+// Whitespace facets, as defined by XML Schema.
+const (
+	WS_PRESERVE = iota // Keep whitespace as is.
+	WS_REPLACE         // Replace tabs, carriage returns and line feeds with spaces.
+	WS_COLLAPSE        // Replace, then merge runs of spaces and trim them at both ends.
+)
+
+// Returns the text of this node and its descendants, in document order.
+// Comments and processing instructions are not included. For nodes other than
+// elements and document roots, this is the value of the node itself.
+func (this *Node) TextContent() string {
+	if this.Type != NT_ELEMENT && this.Type != NT_ROOT {
+		return this.Value
+	}
+
+	var b strings.Builder
+	this.writeText(&b)
+	return b.String()
+}
+
+// Returns the text content of this node, with the given whitespace facet
+// applied.
+func (this *Node) TextContentWS(facet byte) string {
+	return NormalizeWhitespace(this.TextContent(), facet)
+}
+
+func (this *Node) writeText(b *strings.Builder) {
+	for _, v := range this.Children {
+		switch v.Type {
+		case NT_TEXT:
+			b.WriteString(v.Value)
+		case NT_ELEMENT:
+			v.writeText(b)
+		}
+	}
+	b.WriteString(this.Value)
+}
+
+// Replace the children of this node with a single text node holding s, or
+// with nothing if s is empty. For nodes other than elements and document
+// roots, the value of the node itself is set.
+func (this *Node) SetTextContent(s string) {
+	if this.Type != NT_ELEMENT && this.Type != NT_ROOT {
+		this.setValue(s)
+		return
+	}
+
+	this.removeChildren()
+	this.setValue("")
+
+	if len(s) > 0 {
+		t := NewNode(NT_TEXT)
+		t.Value = s
+		this.AddChild(t)
+	}
+}
+
+// Merge adjacent text nodes among the descendants of this node, and remove
+// empty ones.
+func (this *Node) Normalize() {
+	for i := 0; i < len(this.Children); {
+		v := this.Children[i]
+		switch {
+		case v.Type == NT_ELEMENT:
+			v.Normalize()
+		case v.Type != NT_TEXT:
+		case len(v.Value) == 0:
+			this.RemoveChild(v)
+			continue
+		case i > 0 && this.Children[i-1].Type == NT_TEXT:
+			prev := this.Children[i-1]
+			prev.setValue(prev.Value + v.Value)
+			this.RemoveChild(v)
+			continue
+		}
+		i++
+	}
+}
+
+// Returns s with the given whitespace facet applied.
+func NormalizeWhitespace(s string, facet byte) string {
+	switch facet {
+	case WS_REPLACE:
+		return strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return ' '
+			}
+			return r
+		}, s)
+	case WS_COLLAPSE:
+		return strings.Join(strings.FieldsFunc(s, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+		}), " ")
+	}
+	return s
+}
+
+// setValue changes the Value field of this node.
+func (this *Node) setValue(s string) {
+	if old := this.Value; old != s {
+		this.Value = s
+		this.record(MutationRecord{Type: MR_VALUE, Target: this, OldValue: old, NewValue: s})
+	}
+}
+
+// removeChildren removes all children of this node, last first.
+func (this *Node) removeChildren() {
+	for i := len(this.Children) - 1; i >= 0; i-- {
+		this.RemoveChild(this.Children[i])
+	}
+}
@@ -0,0 +1,323 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// apply makes the change again, or reverts it if undo is set. Returns false if
+// the tree no longer matches the change, because it was modified in a way
+// which was not recorded.
+func (this MutationRecord) apply(undo bool) bool {
+	t := this.Target
+	switch this.Type {
+	case MR_INSERT, MR_REMOVE:
+		if (this.Type == MR_INSERT) == undo {
+			if this.Index >= len(t.Children) || t.Children[this.Index] != this.Child {
+				return false
+			}
+			t.removeChild(this.Index)
+		} else {
+			// The child may have been moved to a tree whose changes are
+			// not recorded since.
+			if p := this.Child.Parent; p != nil {
+				if i := indexOf(p.Children, this.Child); i > -1 {
+					p.removeChild(i)
+				}
+			}
+			if this.Index > len(t.Children) {
+				return false
+			}
+			t.insertChild(this.Index, this.Child)
+		}
+
+	case MR_ATTR_ADD, MR_ATTR_REMOVE:
+		if (this.Type == MR_ATTR_ADD) == undo {
+			if this.Index >= len(t.Attributes) || t.Attributes[this.Index] != this.Attr {
+				return false
+			}
+			t.removeAttr(this.Index)
+		} else {
+			if this.Index > len(t.Attributes) {
+				return false
+			}
+			t.insertAttr(this.Index, this.Attr)
+		}
+
+	case MR_ATTR_SET:
+		if undo {
+			this.Attr.Value = this.OldValue
+		} else {
+			this.Attr.Value = this.NewValue
+		}
+
+	case MR_VALUE:
+		if undo {
+			this.Target.Value = this.OldValue
+		} else {
+			this.Target.Value = this.NewValue
+		}
+
+	case MR_RENAME:
+		name := this.NewName
+		if undo {
+			name = this.OldName
+		}
+		if this.Attr != nil {
+			this.Attr.Name = name
+		} else {
+			this.Target.Name = name
+		}
+	}
+	return true
+}
+
+// Tx records the changes made to a document, so they can be committed as a
+// whole or rolled back. See Document.Begin.
+type Tx struct {
+	doc    *Document
+	parent *Tx              // Enclosing transaction, if any.
+	log    []MutationRecord // Changes in the order they were made.
+	done   bool
+}
+
+// Start a transaction. From then on, changes made to the document through
+// the methods of Node are recorded, as described for MutationRecord.
+//
+// Transactions may be nested; committing an inner transaction adds its
+// changes to the enclosing one. Once the outermost transaction is committed,
+// its changes form a single step for Undo and Redo. Changes made outside of
+// transactions, after the first one was started, are undone one by one.
+func (this *Document) Begin() *Tx {
+	this.track()
+	this.history = true
+
+	tx := &Tx{doc: this, parent: this.tx}
+	this.tx = tx
+	return tx
+}
+
+// Keep the changes made in this transaction.
+func (this *Tx) Commit() error {
+	if err := this.finish(); err != nil {
+		return err
+	}
+
+	switch doc := this.doc; {
+	case this.parent != nil:
+		this.parent.log = append(this.parent.log, this.log...)
+	case len(this.log) > 0:
+		doc.undo = append(doc.undo, this.log)
+		doc.redo = nil
+	}
+	return nil
+}
+
+// Revert the changes made in this transaction, leaving the document as it was
+// when the transaction started. If the document was changed in ways which
+// were not recorded, eg: by assigning to the fields of its nodes, the changes
+// may no longer be reverted; then the document is left as is, and an error is
+// returned.
+func (this *Tx) Rollback() error {
+	if err := this.finish(); err != nil {
+		return err
+	}
+	if !this.doc.replay(this.log, true) {
+		return errChangedOutside
+	}
+	return nil
+}
+
+var errChangedOutside = errors.New("xmlx: document was changed without recording it")
+
+func (this *Tx) finish() error {
+	switch {
+	case this.done:
+		return errors.New("xmlx: transaction already finished")
+	case this.doc.tx != this:
+		return errors.New("xmlx: nested transaction still open")
+	}
+
+	this.done = true
+	this.doc.tx = this.parent
+	return nil
+}
+
+// Revert the most recent committed transaction or change. Returns false if
+// there is nothing to undo, or a transaction is open. It also returns false if
+// the document was changed in ways which were not recorded, so the change can
+// no longer be reverted; then the document is left as is, and the history is
+// cleared.
+func (this *Document) Undo() bool {
+	if this.tx != nil || len(this.undo) == 0 {
+		return false
+	}
+
+	list := this.undo[len(this.undo)-1]
+	this.undo = this.undo[:len(this.undo)-1]
+	if !this.replay(list, true) {
+		this.undo, this.redo = nil, nil
+		return false
+	}
+	this.redo = append(this.redo, list)
+	return true
+}
+
+// Make the most recently undone transaction or change again. Returns false if
+// there is nothing to redo, or a transaction is open. Like Undo, it also
+// returns false and clears the history if the change no longer applies.
+func (this *Document) Redo() bool {
+	if this.tx != nil || len(this.redo) == 0 {
+		return false
+	}
+
+	list := this.redo[len(this.redo)-1]
+	this.redo = this.redo[:len(this.redo)-1]
+	if !this.replay(list, false) {
+		this.undo, this.redo = nil, nil
+		return false
+	}
+	this.undo = append(this.undo, list)
+	return true
+}
+
+// replay applies the given changes in order, or reverts them in reverse
+// order if undo is set. If one of them no longer applies, the ones made so
+// far are reverted again, and false is returned.
+func (this *Document) replay(list []MutationRecord, undo bool) bool {
+	this.replaying = true
+	defer func() { this.replaying = false }()
+
+	at := func(i int) MutationRecord {
+		if undo {
+			return list[len(list)-1-i]
+		}
+		return list[i]
+	}
+
+	step := func(m MutationRecord, undo bool) bool {
+		if !m.apply(undo) {
+			return false
+		}
+		if undo {
+			m = m.inverse()
+		}
+		this.record(m)
+		return true
+	}
+
+	for i := range list {
+		if !step(at(i), undo) {
+			for i--; i >= 0; i-- {
+				step(at(i), !undo)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (this *Document) record(m MutationRecord) {
+	switch {
+	case this.replaying:
+		m.Replay = true
+	case this.tx != nil:
+		this.tx.log = append(this.tx.log, m)
+	case this.history:
+		this.undo = append(this.undo, []MutationRecord{m})
+		this.redo = nil
+	}
+
+	for _, o := range this.observers {
+		o.fn(m)
+	}
+}
+
+// setRoot makes the children of root the content of this document. If its
+// changes are recorded, they are moved into Root node by node, so observers
+// see the change, and it can be undone as a single step. Otherwise root takes
+// the place of Root.
+func (this *Document) setRoot(root *Node) {
+	if this.Root == nil || this.Root.owner != this {
+		this.Root = root
+		return
+	}
+
+	if this.history {
+		tx := this.Begin()
+		defer tx.Commit()
+	}
+
+	for len(this.Root.Children) > 0 {
+		this.Root.RemoveChild(this.Root.Children[len(this.Root.Children)-1])
+	}
+	for len(root.Children) > 0 {
+		this.Root.AddChild(root.Children[0])
+	}
+}
+
+// tracking counts the documents which ever recorded or observed changes. As
+// long as there are none, changes need not be passed on, and the walk up to
+// the root of the tree is skipped.
+var tracking int32
+
+// track makes the changes to this document's tree reach Document.record.
+func (this *Document) track() {
+	if this.Root == nil {
+		this.Root = NewNode(NT_ROOT)
+	}
+	this.Root.owner = this
+
+	if !this.tracked {
+		this.tracked = true
+		atomic.AddInt32(&tracking, 1)
+	}
+}
+
+// record passes a change to the document this node belongs to, if its
+// changes are recorded. Trees which were the document's Root before it was
+// replaced by assignment no longer report their changes.
+func (this *Node) record(m MutationRecord) {
+	if atomic.LoadInt32(&tracking) == 0 {
+		return
+	}
+
+	root := this
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	if root.owner != nil && root.owner.Root == root {
+		root.owner.record(m)
+	}
+}
+
+func (this *Node) insertChild(i int, t *Node) {
+	this.Children = append(this.Children, nil)
+	copy(this.Children[i+1:], this.Children[i:])
+	this.Children[i] = t
+	t.Parent = this
+}
+
+func (this *Node) removeChild(i int) {
+	t := this.Children[i]
+	copy(this.Children[i:], this.Children[i+1:])
+	this.Children[len(this.Children)-1] = nil
+	this.Children = this.Children[:len(this.Children)-1]
+	t.Parent = nil
+}
+
+func (this *Node) insertAttr(i int, a *Attr) {
+	this.Attributes = append(this.Attributes, nil)
+	copy(this.Attributes[i+1:], this.Attributes[i:])
+	this.Attributes[i] = a
+}
+
+func (this *Node) removeAttr(i int) {
+	copy(this.Attributes[i:], this.Attributes[i+1:])
+	this.Attributes[len(this.Attributes)-1] = nil
+	this.Attributes = this.Attributes[:len(this.Attributes)-1]
+}
@@ -0,0 +1,177 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import "strings"
+
+// Rule selects nodes for Transform, and computes what takes their place. A
+// rule without Match applies to all nodes; one without Action keeps them.
+type Rule struct {
+	Match  func(n *Node) bool    // Returns true if the rule applies to n.
+	Action func(n *Node) []*Node // Returns the nodes to put in place of n.
+}
+
+// Returns a rule applying action to elements with the given namespace uri and
+// name. Either may be "*" to match any value.
+func MatchName(namespace, name string, action func(n *Node) []*Node) Rule {
+	return Rule{
+		Match: func(n *Node) bool {
+			return n.Type == NT_ELEMENT && (namespace == "*" || n.Name.Space == namespace) &&
+				(name == "*" || n.Name.Local == name)
+		},
+		Action: action,
+	}
+}
+
+// Returns a rule applying action to the nodes for which match returns true.
+func MatchFunc(match func(n *Node) bool, action func(n *Node) []*Node) Rule {
+	return Rule{Match: match, Action: action}
+}
+
+// Returns a rule applying action to elements at the end of the given path of
+// element names, separated by slashes. (eg: "book/title") A path starting
+// with a slash must lead up to the document element. Each step is a local
+// name matching elements in any namespace, "{uri}name" to match a namespace
+// as well, or "*" to match any element.
+func MatchPath(path string, action func(n *Node) []*Node) Rule {
+	absolute := strings.HasPrefix(path, "/")
+	steps := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	return Rule{
+		Match: func(n *Node) bool {
+			for i := len(steps) - 1; i >= 0; i-- {
+				if n == nil || n.Type != NT_ELEMENT || !matchStep(n, steps[i]) {
+					return false
+				}
+				n = n.Parent
+			}
+			return !absolute || n == nil || n.Type == NT_ROOT
+		},
+		Action: action,
+	}
+}
+
+// matchStep returns true if element n matches the given step of a path. See
+// MatchPath.
+func matchStep(n *Node, step string) bool {
+	if step == "*" {
+		return true
+	}
+	if !strings.HasPrefix(step, "{") {
+		return n.Name.Local == step
+	}
+
+	end := strings.IndexByte(step, '}')
+	if end < 0 {
+		return false
+	}
+	return n.Name.Space == step[1:end] && (step[end+1:] == "*" || n.Name.Local == step[end+1:])
+}
+
+// Delete is an action for rules removing the nodes they match.
+func Delete(n *Node) []*Node { return nil }
+
+// Transform applies the given rules to root and its descendants, in document
+// order. For each node, the first rule which matches it is applied, and the
+// nodes returned by its action take its place. An action returning nil
+// deletes the node; one returning the node itself keeps it, even if it was
+// changed. Nodes without a matching rule are kept as well.
+//
+// The children of a node which is kept are visited after its action ran, so
+// they include children added by it. Nodes returned in place of another are
+// not visited, nor are siblings inserted by an action; call Transform on them
+// from the action if they need to be transformed as well. Nodes which an
+// action removed from the tree are skipped. The changes are made through the
+// methods of Node, so they can be observed and undone.
+//
+// Returns the nodes which took the place of root.
+func Transform(root *Node, rules ...Rule) []*Node {
+	return transformer(rules).node(root)
+}
+
+type transformer []Rule
+
+// node applies the first matching rule to n, and puts the result in its
+// place.
+func (this transformer) node(n *Node) []*Node {
+	p := n.Parent
+	var next *Node
+	at := -1
+	if p != nil {
+		if at = indexOf(p.Children, n); at+1 < len(p.Children) {
+			next = p.Children[at+1]
+		}
+	}
+
+	list := []*Node{n}
+	for _, r := range this {
+		if r.Match == nil || r.Match(n) {
+			if r.Action != nil {
+				list = r.Action(n)
+			}
+			break
+		}
+	}
+
+	if p != nil && (len(list) != 1 || list[0] != n || n.Parent != p) {
+		this.replace(p, n, next, at, list)
+	}
+
+	if indexOf(list, n) > -1 {
+		this.children(n)
+	}
+	return list
+}
+
+// replace puts the given nodes in the place of n, a child of p, or the one it
+// had before it was moved away; next was the sibling following it then, and
+// at its position.
+func (this transformer) replace(p, n, next *Node, at int, list []*Node) {
+	// The nodes go in front of the first following sibling which is not
+	// part of the list itself. If n and next are both gone, that is the
+	// sibling now at the position of n.
+	i := indexOf(p.Children, n)
+	switch {
+	case i > -1:
+		i++
+	case next != nil && next.Parent == p:
+		i = indexOf(p.Children, next)
+	default:
+		i = at
+	}
+
+	var anchor *Node
+	for ; i > -1 && i < len(p.Children); i++ {
+		if indexOf(list, p.Children[i]) < 0 {
+			anchor = p.Children[i]
+			break
+		}
+	}
+
+	if n.Parent == p {
+		n.Detach()
+	}
+	for _, v := range list {
+		if v != nil && !p.isInside(v) {
+			v.Detach()
+		}
+	}
+
+	for _, v := range list {
+		if v != nil {
+			p.InsertBefore(v, anchor)
+		}
+	}
+}
+
+// children transforms the children of n. The list is copied first, so rules
+// can change it while it is traversed.
+func (this transformer) children(n *Node) {
+	for _, v := range append([]*Node(nil), n.Children...) {
+		if v.Parent == n {
+			this.node(v)
+		}
+	}
+}
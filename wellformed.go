@@ -0,0 +1,235 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+	Checks applied by SaveOptions.Strict. The tree is validated before anything
+	is written, and the output is held back until it is complete, so a failed
+	save never produces partial output. Text and
+	attribute values need no checks beyond their characters; the strict
+	printer escapes them fully.
+*/
+
+// checkDocument verifies that the document can be written as well-formed XML.
+func (this *Document) checkDocument() error {
+	if this.SaveDocType {
+		switch this.Version {
+		case "1.0", "1.1":
+		default:
+			return fmt.Errorf("xmlx: invalid xml version %q", this.Version)
+		}
+
+		if len(this.Encoding) > 0 && !isEncodingName(this.Encoding) {
+			return fmt.Errorf("xmlx: invalid encoding name %q", this.Encoding)
+		}
+
+		switch this.StandAlone {
+		case "", "yes", "no":
+		default:
+			return fmt.Errorf("xmlx: invalid standalone value %q", this.StandAlone)
+		}
+	}
+
+	if this.Root == nil {
+		return fmt.Errorf("xmlx: document has no root node")
+	}
+
+	elements := 0
+	for _, v := range this.Root.Children {
+		switch v.Type {
+		case NT_ELEMENT:
+			elements++
+		case NT_TEXT:
+			if !isWhitespace(v) {
+				return fmt.Errorf("xmlx: text outside of the document element")
+			}
+		}
+	}
+
+	if elements != 1 {
+		return fmt.Errorf("xmlx: document must have exactly one element, found %d", elements)
+	}
+
+	return checkNode(this.Root)
+}
+
+// checkNode verifies n and its descendants.
+func checkNode(n *Node) error {
+	switch n.Type {
+	case NT_TEXT:
+		return checkChars(n, n.Value)
+
+	case NT_COMMENT:
+		if strings.Contains(n.Value, "--") {
+			return nodeError(n, `comment contains "--"`)
+		}
+		return checkChars(n, n.Value)
+
+	case NT_PROCINST:
+		if !isName(n.Target) || strings.Contains(n.Target, ":") {
+			return nodeError(n, fmt.Sprintf("invalid processing instruction target %q", n.Target))
+		}
+		if strings.EqualFold(n.Target, "xml") {
+			return nodeError(n, `processing instruction target "xml" is reserved`)
+		}
+		if strings.Contains(n.Value, "?>") {
+			return nodeError(n, `processing instruction contains "?>"`)
+		}
+		return checkChars(n, n.Value)
+
+	case NT_DIRECTIVE:
+		if strings.Count(n.Value, "<") != strings.Count(n.Value, ">") {
+			return nodeError(n, "unbalanced directive")
+		}
+		return checkChars(n, n.Value)
+
+	case NT_ELEMENT:
+		if err := checkElement(n); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range n.Children {
+		if v.Parent != n {
+			return nodeError(v, "node has an inconsistent parent")
+		}
+		if err := checkNode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkElement(n *Node) error {
+	if !isNCName(n.Name.Local) {
+		return nodeError(n, fmt.Sprintf("invalid element name %q", n.Name.Local))
+	}
+
+	if prefix, ok := n.lookupPrefix(n.Name.Space, true); ok && len(prefix) > 0 && !isNCName(prefix) {
+		return nodeError(n, fmt.Sprintf("invalid prefix %q", prefix))
+	}
+
+	if err := checkChars(n, n.Value); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(n.Attributes))
+	for _, a := range n.Attributes {
+		name := a.Name.Local
+		if len(a.Name.Space) > 0 {
+			// Namespaces without a prefix in scope are declared on save,
+			// with a prefix of their own.
+			prefix, ok := n.lookupPrefix(a.Name.Space, false)
+			if !ok {
+				prefix = a.Name.Space
+			} else if !isNCName(prefix) {
+				return nodeError(n, fmt.Sprintf("invalid prefix %q", prefix))
+			}
+			name = prefix + ":" + name
+		}
+
+		if !isNCName(a.Name.Local) {
+			return nodeError(n, fmt.Sprintf("invalid attribute name %q", a.Name.Local))
+		}
+
+		if seen[name] {
+			return nodeError(n, fmt.Sprintf("duplicate attribute %q", name))
+		}
+		seen[name] = true
+
+		if err := checkChars(n, a.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkChars verifies that s consists of valid utf-8 encoded XML characters.
+func checkChars(n *Node, s string) error {
+	for i, r := range s {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				return nodeError(n, "invalid utf-8")
+			}
+		}
+		if !isChar(r) {
+			return nodeError(n, fmt.Sprintf("illegal character %U", r))
+		}
+	}
+	return nil
+}
+
+// nodeError creates an error describing a problem with n, prefixed by the
+// path to the nearest element.
+func nodeError(n *Node, msg string) error {
+	var path []string
+	for p := n; p != nil; p = p.Parent {
+		if p.Type == NT_ELEMENT {
+			path = append([]string{p.Name.Local}, path...)
+		}
+	}
+	return fmt.Errorf("xmlx: /%s: %s", strings.Join(path, "/"), msg)
+}
+
+// isChar returns true if r matches the Char production of the XML spec.
+func isChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+func isNameStart(r rune) bool {
+	return r == ':' || r == '_' ||
+		r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' ||
+		r >= 0xC0 && r <= 0xD6 || r >= 0xD8 && r <= 0xF6 ||
+		r >= 0xF8 && r <= 0x2FF || r >= 0x370 && r <= 0x37D ||
+		r >= 0x37F && r <= 0x1FFF || r >= 0x200C && r <= 0x200D ||
+		r >= 0x2070 && r <= 0x218F || r >= 0x2C00 && r <= 0x2FEF ||
+		r >= 0x3001 && r <= 0xD7FF || r >= 0xF900 && r <= 0xFDCF ||
+		r >= 0xFDF0 && r <= 0xFFFD || r >= 0x10000 && r <= 0xEFFFF
+}
+
+func isNameChar(r rune) bool {
+	return isNameStart(r) || r == '-' || r == '.' ||
+		r >= '0' && r <= '9' || r == 0xB7 ||
+		r >= 0x300 && r <= 0x36F || r >= 0x203F && r <= 0x2040
+}
+
+// isName returns true if s matches the Name production of the XML spec.
+func isName(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i, r := range s {
+		if i == 0 && !isNameStart(r) || !isNameChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNCName returns true if s is a Name without colons.
+func isNCName(s string) bool {
+	return isName(s) && !strings.Contains(s, ":")
+}
+
+func isEncodingName(s string) bool {
+	for i, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-'):
+		default:
+			return false
+		}
+	}
+	return len(s) > 0
+}
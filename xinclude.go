@@ -0,0 +1,362 @@
+// This work is subject to the CC0 1.0 Universal (CC0 1.0) Public Domain Dedication
+// license. Its contents can be found at:
+// http://creativecommons.org/publicdomain/zero/1.0/
+
+package xmlx
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	nsXInclude = "http://www.w3.org/2001/XInclude"
+	nsXML      = "http://www.w3.org/XML/1998/namespace"
+)
+
+// Replace all xi:include elements in this document with the content they
+// refer to. The href attribute is resolved relative to the xml:base in effect
+// for the include element, or the location the document was loaded from.
+// Both parse="xml" and parse="text" are supported. The xpointer attribute may
+// hold a shorthand id or element() scheme pointers, such as "element(id/2)".
+// If a resource can not be loaded, the content of the xi:fallback child is used
+// instead. Included content is processed recursively; inclusion loops are
+// reported as errors. If loader is nil, DefaultLoader is used. If the document
+// has a Catalog, uris are mapped through it before they are loaded.
+func (this *Document) ProcessXIncludes(loader Loader) error {
+	if loader == nil {
+		loader = DefaultLoader
+	}
+
+	if this.Catalog != nil {
+		loader = this.Catalog.Loader(loader)
+	}
+
+	x := &xincluder{loader: loader, stack: []string{this.BaseURI + "#"}}
+	return x.process(this, this.Root)
+}
+
+type xincluder struct {
+	loader Loader
+	stack  []string // Resources currently being included, to detect loops.
+}
+
+// process expands all include elements among the descendants of n.
+func (this *xincluder) process(doc *Document, n *Node) error {
+	for i := 0; i < len(n.Children); i++ {
+		list, err := this.expand(doc, n.Children[i])
+		if err != nil {
+			return err
+		}
+
+		if len(list) == 1 && list[0] == n.Children[i] {
+			continue
+		}
+
+		old := n.Children[i]
+		for _, v := range list {
+			n.InsertBefore(v, old)
+		}
+		old.Detach()
+		i += len(list) - 1
+	}
+	return nil
+}
+
+// expand returns the nodes which replace n. This is n itself, unless it is an
+// include element.
+func (this *xincluder) expand(doc *Document, n *Node) ([]*Node, error) {
+	if n.Type != NT_ELEMENT {
+		return []*Node{n}, nil
+	}
+
+	if n.Name.Space != nsXInclude || n.Name.Local != "include" {
+		return []*Node{n}, this.process(doc, n)
+	}
+
+	href := n.As("", "href")
+	xpointer := n.As("", "xpointer")
+	parse := n.As("", "parse")
+
+	switch {
+	case parse == "":
+		parse = "xml"
+	case parse != "xml" && parse != "text":
+		return nil, fmt.Errorf("xmlx: invalid xi:include parse attribute %q", parse)
+	}
+
+	if len(href) == 0 && len(xpointer) == 0 {
+		return nil, errors.New("xmlx: xi:include requires an href or xpointer attribute")
+	}
+
+	if parse == "text" && len(xpointer) > 0 {
+		return nil, errors.New("xmlx: xi:include with parse=\"text\" can not have an xpointer")
+	}
+
+	uri := doc.BaseURI
+	if len(href) > 0 {
+		uri = resolveURI(baseURI(doc, n), href)
+	}
+
+	key := uri + "#" + xpointer
+	if parse == "text" {
+		key = "text:" + uri
+	}
+
+	for _, v := range this.stack {
+		if v == key {
+			return nil, fmt.Errorf("xmlx: xi:include recursion on %s", key)
+		}
+	}
+
+	list, err := this.fetch(doc, n, uri, len(href) == 0, parse, xpointer, key)
+	if err == nil {
+		return list, nil
+	}
+
+	fb := n.SelectNodesDirect(nsXInclude, "fallback")
+	if len(fb) == 0 {
+		return nil, err
+	}
+
+	if err = this.process(doc, fb[0]); err != nil {
+		return nil, err
+	}
+
+	list = append([]*Node(nil), fb[0].Children...)
+	fb[0].removeChildren()
+	return list, nil
+}
+
+// fetch loads the resource referenced by an include element and returns the
+// nodes selected from it, with all nested includes expanded.
+func (this *xincluder) fetch(doc *Document, n *Node, uri string, local bool, parse, xpointer, key string) ([]*Node, error) {
+	if parse == "text" {
+		return this.fetchText(n, uri)
+	}
+
+	src := doc
+	if !local {
+		r, err := this.loader(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		defer r.Close()
+
+		// Entities declared by the included document stay its own.
+		src = New()
+		for k, v := range doc.Entity {
+			src.Entity[k] = v
+		}
+		src.BaseURI = uri
+		src.Catalog = doc.Catalog
+		src.InternalEntities = doc.InternalEntities
+		if err = src.LoadStream(r, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	this.stack = append(this.stack, key)
+	defer func() { this.stack = this.stack[:len(this.stack)-1] }()
+
+	if len(xpointer) == 0 {
+		if err := this.process(src, src.Root); err != nil {
+			return nil, err
+		}
+
+		list := make([]*Node, 0, len(src.Root.Children))
+		for _, v := range src.Root.Children {
+			if v.Type != NT_DIRECTIVE {
+				v.Parent = nil
+				list = append(list, v)
+			}
+		}
+		return list, nil
+	}
+
+	sel, err := evalXPointer(src.Root, xpointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if local {
+		c := sel.Clone()
+		inheritNamespaces(c, sel)
+		sel = c
+	} else {
+		inheritNamespaces(sel, sel)
+	}
+
+	// Expand nested includes while sel is still attached to its tree, so
+	// they see the proper xml:base context.
+	list, err := this.expand(src, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range list {
+		v.Detach()
+	}
+	return list, nil
+}
+
+func (this *xincluder) fetchText(n *Node, uri string) ([]*Node, error) {
+	switch strings.ToLower(n.As("", "encoding")) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+	default:
+		return nil, fmt.Errorf("xmlx: unsupported xi:include encoding %q", n.As("", "encoding"))
+	}
+
+	r, err := this.loader(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("xmlx: %s is not valid utf-8", uri)
+	}
+
+	t := NewNode(NT_TEXT)
+	t.Value = string(data)
+	return []*Node{t}, nil
+}
+
+// baseURI returns the base uri in effect for n, taking all xml:base attributes
+// of n and its ancestors into account.
+func baseURI(doc *Document, n *Node) string {
+	var list []string
+	for ; n != nil; n = n.Parent {
+		if v := n.As(nsXML, "base"); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+
+	base := doc.BaseURI
+	for i := len(list) - 1; i >= 0; i-- {
+		base = resolveURI(base, list[i])
+	}
+	return base
+}
+
+// evalXPointer finds the element addressed by the given pointer. Supported are
+// shorthand pointers (a bare id) and element() scheme pointers. If multiple
+// pointer parts are given, the first one which matches is used.
+func evalXPointer(root *Node, ptr string) (*Node, error) {
+	ptr = strings.TrimSpace(ptr)
+	if !strings.Contains(ptr, "(") {
+		if n := selectID(root, ptr); n != nil {
+			return n, nil
+		}
+		return nil, fmt.Errorf("xmlx: xpointer %q matches no element", ptr)
+	}
+
+	for len(ptr) > 0 {
+		i := strings.Index(ptr, "(")
+		j := strings.Index(ptr, ")")
+		if i < 0 || j < i {
+			return nil, fmt.Errorf("xmlx: malformed xpointer %q", ptr)
+		}
+
+		scheme := strings.TrimSpace(ptr[:i])
+		data := ptr[i+1 : j]
+		ptr = strings.TrimSpace(ptr[j+1:])
+
+		if scheme != "element" {
+			continue
+		}
+
+		if n := evalElementScheme(root, data); n != nil {
+			return n, nil
+		}
+	}
+
+	return nil, errors.New("xmlx: xpointer matches no element")
+}
+
+// evalElementScheme evaluates the data of an element() pointer, which is either
+// an id, optionally followed by a child sequence, or a child sequence
+// starting at the document root. (eg: "intro", "intro/2/1" or "/1/3")
+func evalElementScheme(root *Node, data string) *Node {
+	steps := strings.Split(data, "/")
+
+	n := root
+	if len(steps[0]) > 0 {
+		if n = selectID(root, steps[0]); n == nil {
+			return nil
+		}
+	}
+
+	for _, s := range steps[1:] {
+		idx, err := strconv.Atoi(s)
+		if err != nil || idx < 1 {
+			return nil
+		}
+
+		var next *Node
+		for _, v := range n.Children {
+			if v.Type != NT_ELEMENT {
+				continue
+			}
+			if idx--; idx == 0 {
+				next = v
+				break
+			}
+		}
+
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+
+	if n == root {
+		return nil
+	}
+	return n
+}
+
+// selectID finds the first element carrying the given xml:id or id attribute.
+func selectID(cn *Node, id string) *Node {
+	if cn.Type == NT_ELEMENT {
+		for _, v := range cn.Attributes {
+			if v.Value == id && v.Name.Local == "id" && (v.Name.Space == "" || v.Name.Space == nsXML) {
+				return cn
+			}
+		}
+	}
+
+	for _, v := range cn.Children {
+		if n := selectID(v, id); n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// inheritNamespaces copies the namespace declarations src inherits from its
+// ancestors onto dst, so dst can be moved to a different tree without losing
+// them.
+func inheritNamespaces(dst, src *Node) {
+	for p := src.Parent; p != nil; p = p.Parent {
+		for _, a := range p.Attributes {
+			if a.Name.Space != "xmlns" && (a.Name.Space != "" || a.Name.Local != "xmlns") {
+				continue
+			}
+			if !dst.HasAttr(a.Name.Space, a.Name.Local) {
+				dst.Attributes = append(dst.Attributes, &Attr{Name: a.Name, Value: a.Value})
+			}
+		}
+	}
+}
@@ -5,8 +5,16 @@
 package xmlx
 
 import (
+	"archive/zip"
+	"bytes"
 	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadLocal(t *testing.T) {
@@ -398,3 +406,1568 @@ func TestSelectNodesDirect(t *testing.T) {
 		t.Errorf("Unexcepted hidden nodes found. Expected: 2, Got: %d", len(nodes))
 	}
 }
+
+func TestPackage(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.docx")
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	parts := []struct{ name, data string }{
+		{"[Content_Types].xml", `<Types><Default Extension="xml" /></Types>`},
+		{"word/document.xml", `<document><body><p>hello</p></body></document>`},
+		{"media/image1.bin", "\x00\x01\x02"},
+	}
+	for _, p := range parts {
+		w, err := zw.Create(p.name)
+		if err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+		w.Write([]byte(p.data))
+	}
+	zw.Close()
+
+	if err := ioutil.WriteFile(src, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("WriteFile(): %s", err)
+	}
+
+	pkg, err := OpenPackage(src)
+	if err != nil {
+		t.Fatalf("OpenPackage(): %s", err)
+	}
+	defer pkg.Close()
+
+	if list := pkg.Parts(); len(list) != 3 || list[1] != "word/document.xml" {
+		t.Fatalf("Parts(): unexpected list %v", list)
+	}
+
+	doc, err := pkg.LoadPart("word/document.xml", nil)
+	if err != nil {
+		t.Fatalf("LoadPart(): %s", err)
+	}
+
+	doc.SelectNode("", "p").SetValue("world")
+	pkg.SetPart("word/document.xml", doc)
+	pkg.SetPart("custom/item1.xml", doc)
+
+	dst := filepath.Join(dir, "dst.docx")
+	if err = pkg.SaveFile(src); err == nil {
+		t.Errorf("SaveFile(): expected error when overwriting the source")
+	}
+	if err = pkg.SaveFile(dst); err != nil {
+		t.Fatalf("SaveFile(): %s", err)
+	}
+
+	out, err := OpenPackage(dst)
+	if err != nil {
+		t.Fatalf("OpenPackage(): %s", err)
+	}
+	defer out.Close()
+
+	if list := out.Parts(); len(list) != 4 || list[3] != "custom/item1.xml" {
+		t.Fatalf("Parts(): unexpected list %v", list)
+	}
+
+	if doc, err = out.LoadPart("word/document.xml", nil); err != nil {
+		t.Fatalf("LoadPart(): %s", err)
+	}
+	if v := doc.SelectNode("", "p").GetValue(); v != "world" {
+		t.Errorf("Modified part has wrong value. Expected 'world', got '%s'.", v)
+	}
+
+	r, err := out.Open("media/image1.bin")
+	if err != nil {
+		t.Fatalf("Open(): %s", err)
+	}
+	defer r.Close()
+
+	if data, _ := ioutil.ReadAll(r); string(data) != "\x00\x01\x02" {
+		t.Errorf("Untouched part was altered: %q", data)
+	}
+}
+
+func TestXInclude(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.xml": `<config xmlns:xi="http://www.w3.org/2001/XInclude">
+<xi:include href="parts/db.xml" />
+<notes><xi:include href="parts/notes.txt" parse="text" /></notes>
+<xi:include href="parts/db.xml" xpointer="element(backup/1)" />
+<xi:include href="missing.xml"><xi:fallback><none /></xi:fallback></xi:include>
+</config>`,
+		"parts/db.xml":    `<db xmlns:xi="http://www.w3.org/2001/XInclude"><host>localhost</host><xi:include href="../shared.xml" xpointer="port" /><backup id="backup"><host>remote</host></backup></db>`,
+		"shared.xml":      `<!DOCTYPE shared [<!ENTITY n "5432">]><shared><port id="port">&n;</port></shared>`,
+		"parts/notes.txt": "a < b",
+		"loop.xml":        `<loop xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="loop.xml" /></loop>`,
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("WriteFile(): %s", err)
+		}
+	}
+
+	doc := New()
+	doc.InternalEntities = true
+	if err := doc.LoadFile(filepath.Join(dir, "main.xml"), nil); err != nil {
+		t.Fatalf("LoadFile(): %s", err)
+	}
+
+	if err := doc.ProcessXIncludes(nil); err != nil {
+		t.Fatalf("ProcessXIncludes(): %s", err)
+	}
+
+	if _, ok := doc.Entity["n"]; ok {
+		t.Errorf("Entity of an included document leaked into the including one.")
+	}
+
+	if n := doc.SelectNode(nsXInclude, "include"); n != nil {
+		t.Errorf("Include element was not replaced.")
+	}
+
+	if v := doc.SelectNode("", "db").S("", "port"); v != "5432" {
+		t.Errorf("Nested include failed. Expected '5432', got '%s'.", v)
+	}
+
+	if v := doc.Root.S("", "notes"); v != "a < b" {
+		t.Errorf("Text include failed. Expected 'a < b', got '%s'.", v)
+	}
+
+	cfg := doc.SelectNode("", "config")
+	if list := cfg.SelectNodesDirect("", "host"); len(list) != 1 || list[0].GetValue() != "remote" {
+		t.Errorf("XPointer include failed. Got %d host elements.", len(list))
+	}
+
+	if cfg.SelectNode("", "none") == nil {
+		t.Errorf("Fallback content was not included.")
+	}
+
+	doc = New()
+	if err := doc.LoadFile(filepath.Join(dir, "loop.xml"), nil); err != nil {
+		t.Fatalf("LoadFile(): %s", err)
+	}
+
+	if err := doc.ProcessXIncludes(nil); err == nil {
+		t.Errorf("ProcessXIncludes(): expected recursion error")
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"catalog.xml": `<catalog xmlns="urn:oasis:names:tc:entity:xmlns:xml:catalog">
+<public publicId="-//Test//DTD  Doc//EN" uri="dtd/doc.dtd" />
+<rewriteSystem systemIdStartString="http://example.com/ent/" rewritePrefix="dtd/" />
+<nextCatalog catalog="more/catalog.xml" />
+</catalog>`,
+		"more/catalog.xml": `<catalog xmlns="urn:oasis:names:tc:entity:xmlns:xml:catalog">
+<uri name="http://example.com/feed.xml" uri="../feed.xml" />
+</catalog>`,
+		"dtd/doc.dtd": `<!-- entities -->
+<!ENTITY nbsp "&#160;">
+<!ENTITY % lat PUBLIC "-//Test//ENTITIES Lat//EN" "http://example.com/ent/lat.ent">
+%lat;
+<!ELEMENT doc (#PCDATA)>`,
+		"dtd/lat.ent": `<!ENTITY copy "&#xA9;">`,
+		"feed.xml":    `<feed><title>local</title></feed>`,
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("WriteFile(): %s", err)
+		}
+	}
+
+	cat, err := LoadCatalog(filepath.Join(dir, "catalog.xml"))
+	if err != nil {
+		t.Fatalf("LoadCatalog(): %s", err)
+	}
+
+	if uri := cat.ResolveEntity("-//Test//DTD Doc//EN", ""); uri != filepath.Join(dir, "dtd", "doc.dtd") {
+		t.Errorf("ResolveEntity(): unexpected uri %q", uri)
+	}
+
+	if uri := cat.ResolveEntity("", "http://example.com/ent/x/y.ent"); uri != filepath.Join(dir, "dtd", "x", "y.ent") {
+		t.Errorf("ResolveEntity(): unexpected rewritten uri %q", uri)
+	}
+
+	if uri := cat.ResolveURI("http://example.com/other.xml"); uri != "" {
+		t.Errorf("ResolveURI(): expected no match, got %q", uri)
+	}
+
+	data := `<!DOCTYPE doc PUBLIC "-//Test//DTD Doc//EN" "http://example.com/doc.dtd" [
+<!ENTITY local "here">
+]>
+<doc>&nbsp;&copy;&local;</doc>`
+
+	doc := New()
+	doc.Catalog = cat
+	doc.InternalEntities = true
+	if err = doc.LoadString(data, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	if v := doc.SelectNode("", "doc").GetValue(); v != "©here" {
+		t.Errorf("Entities not resolved. Expected '©here', got %q.", v)
+	}
+
+	doc = New()
+	doc.Catalog = cat
+	if err = doc.LoadUri("http://example.com/feed.xml", nil); err != nil {
+		t.Fatalf("LoadUri(): %s", err)
+	}
+
+	if v := doc.Root.S("", "title"); v != "local" {
+		t.Errorf("LoadUri() did not use the catalog. Got title %q.", v)
+	}
+}
+
+func TestInternalEntities(t *testing.T) {
+	data := `<!DOCTYPE doc [<!ENTITY a "x&#65;">]><doc>&a;</doc>`
+
+	doc := New()
+	if err := doc.LoadString(data, nil); err == nil {
+		t.Errorf("LoadString(): expected an error for an undeclared entity")
+	}
+
+	doc = New()
+	doc.InternalEntities = true
+	if err := doc.LoadString(data, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	if v := doc.SelectNode("", "doc").GetValue(); v != "xA" {
+		t.Errorf("Expected 'xA', got %q", v)
+	}
+
+	laughs := `<!ENTITY l0 "lol">`
+	for i := 1; i < 10; i++ {
+		laughs += fmt.Sprintf(`<!ENTITY l%d "%s">`, i, strings.Repeat(fmt.Sprintf("&l%d;", i-1), 10))
+	}
+
+	deep := `<!ENTITY d0 "x">`
+	for i := 1; i <= 20; i++ {
+		deep += fmt.Sprintf(`<!ENTITY d%d "&d%d;">`, i, i-1)
+	}
+
+	params := `<!ENTITY % p0 "<!-- x -->">`
+	for i := 1; i < 10; i++ {
+		params += fmt.Sprintf(`<!ENTITY %% p%d "%s">`, i, strings.Repeat(fmt.Sprintf("%%p%d;", i-1), 10))
+	}
+	params += `%p9;`
+
+	bad := []string{
+		`<!DOCTYPE x [<!ENTITY]>><x/>`,
+		`<!DOCTYPE x [<!ENTITY a "b>" ]>><x/>`,
+		`<!DOCTYPE x [` + laughs + `]><x>&l9;</x>`,
+		`<!DOCTYPE x [` + deep + `]><x>&d20;</x>`,
+		`<!DOCTYPE x [` + params + `]><x/>`,
+	}
+
+	for i, data := range bad {
+		doc = New()
+		doc.InternalEntities = true
+		if err := doc.LoadString(data, nil); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
+
+func TestSaveWith(t *testing.T) {
+	data := `<root b="2" a="1" xmlns:x="urn:x">
+  <list><item id="1">one</item>   <item id="2" /><!-- note --></list>
+<p>mixed <b>content</b> stays</p>
+<pre xml:space="preserve"><a>  </a></pre>
+<long first="aaaaaaaaaa" second="bbbbbbbbbb" third="cccccccccc" />
+</root>`
+
+	doc := New()
+	if err := doc.LoadString(data, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	var b bytes.Buffer
+	err := doc.SaveWith(&b, SaveOptions{
+		Indent:       "\t",
+		MaxLineWidth: 40,
+		SelfClose:    SC_COMPACT,
+		QuoteChar:    '\'',
+		SortAttrs:    true,
+	})
+
+	if err != nil {
+		t.Fatalf("SaveWith(): %s", err)
+	}
+
+	expected := `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<root xmlns:x='urn:x' a='1' b='2'>
+	<list>
+		<item id='1'>one</item>
+		<item id='2'/>
+		<!-- note -->
+	</list>
+	<p>mixed <b>content</b> stays</p>
+	<pre xml:space='preserve'><a>  </a></pre>
+	<long first='aaaaaaaaaa'
+		second='bbbbbbbbbb' third='cccccccccc'/>
+</root>
+`
+
+	if got := b.String(); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", expected, got)
+	}
+
+	// Mixed content is escaped, so it survives a reload.
+	if err := doc.LoadString("<p>a &lt; b &amp; c<b>x</b>\n</p>", nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	doc.SaveDocType = false
+
+	out, err := doc.SaveBytesWith(SaveOptions{Indent: "  "})
+	if err != nil {
+		t.Fatalf("SaveBytesWith(): %s", err)
+	}
+	if s := string(out); s != "<p>a &lt; b &amp; c<b>x</b>\n</p>\n" {
+		t.Errorf("mixed content: got %q", s)
+	}
+	if err := New().LoadBytes(out, nil); err != nil {
+		t.Errorf("reload of mixed content: %s", err)
+	}
+}
+
+// benchDocument builds a document like test.xml, with its items repeated n
+// times and each item nested depth levels deep.
+func benchDocument(b *testing.B, n, depth int) *Document {
+	doc := New()
+	if err := doc.LoadFile("test.xml", nil); err != nil {
+		b.Fatalf("LoadFile(): %s", err)
+	}
+
+	ch := doc.SelectNode("", "channel")
+	items := ch.SelectNodesDirect("", "item")
+
+	for i := 0; i < n; i++ {
+		for _, v := range items {
+			c := v.Clone()
+			p := ch
+			for d := 0; d < depth; d++ {
+				w := NewNode(NT_ELEMENT)
+				w.Name.Local = "group"
+				p.AddChild(w)
+				p = w
+			}
+			p.AddChild(c)
+		}
+	}
+	return doc
+}
+
+func benchmarkSave(b *testing.B, n, depth int) {
+	doc := benchDocument(b, n, depth)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := doc.SaveStream(ioutil.Discard); err != nil {
+			b.Fatalf("SaveStream(): %s", err)
+		}
+	}
+}
+
+// BenchmarkLoadDeep checks that loading stays linear in the depth of the
+// document, also while other documents record their changes.
+func BenchmarkLoadDeep(b *testing.B) {
+	data := strings.Repeat("<a>", 20000) + strings.Repeat("</a>", 20000)
+	New().Begin()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := New().LoadString(data, nil); err != nil {
+			b.Fatalf("LoadString(): %s", err)
+		}
+	}
+}
+
+func BenchmarkSaveWide(b *testing.B) { benchmarkSave(b, 1000, 0) }
+func BenchmarkSaveDeep(b *testing.B) { benchmarkSave(b, 20, 100) }
+
+func TestSaveStrict(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString(`<!DOCTYPE a><a xmlns="urn:a" xmlns:b="urn:b"><b:c /></a>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	a := doc.SelectNode("urn:a", "a")
+	a.SetAttr("title", "line 1\n\tline 2 & \"more\"")
+
+	text := NewNode(NT_TEXT)
+	text.Value = "x < y"
+	a.AddChild(text)
+
+	var b bytes.Buffer
+	if err := doc.SaveWith(&b, SaveOptions{Strict: true}); err != nil {
+		t.Fatalf("SaveWith(): %s", err)
+	}
+
+	expected := `<?xml version="1.0" encoding="utf-8" standalone="yes"?><!DOCTYPE a><a xmlns="urn:a" xmlns:b="urn:b" title="line 1&#xA;&#x9;line 2 &amp; &quot;more&quot;"><b:c />x &lt; y</a>`
+	if got := b.String(); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", expected, got)
+	}
+
+	doc2 := New()
+	if err := doc2.LoadBytes(b.Bytes(), nil); err != nil {
+		t.Fatalf("LoadBytes(): %s", err)
+	}
+	if v := doc2.SelectNode("urn:a", "a").As("", "title"); v != "line 1\n\tline 2 & \"more\"" {
+		t.Errorf("Attribute did not survive a reload: %q", v)
+	}
+
+	// The default output escapes the mixed content as well.
+	doc2 = New()
+	if err := doc2.LoadString(doc.String(), nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	if v := doc2.SelectNode("urn:a", "a").GetValue(); v != "x < y" {
+		t.Errorf("Text did not survive a reload: %q", v)
+	}
+
+	bad := []func(){
+		func() {
+			c := NewNode(NT_COMMENT)
+			c.Value = "a -- b"
+			a.AddChild(c)
+		},
+		func() {
+			p := NewNode(NT_PROCINST)
+			p.Target = "php"
+			p.Value = "echo '?>';"
+			a.AddChild(p)
+		},
+		func() { text.Value = "bell \a" },
+		func() { a.SetAttr("in valid", "1") },
+		func() {
+			e := NewNode(NT_ELEMENT)
+			e.Name = xml.Name{Space: "urn:x", Local: "e"}
+			e.SetAttrNS("xmlns", "1x", "urn:x")
+			a.AddChild(e)
+		},
+	}
+
+	for i, f := range bad {
+		doc2 = New()
+		doc2.LoadBytes(b.Bytes(), nil)
+		a = doc2.SelectNode("urn:a", "a")
+		text = a.Children[len(a.Children)-1]
+		f()
+
+		var out bytes.Buffer
+		if err := doc2.SaveWith(&out, SaveOptions{Strict: true}); err == nil {
+			t.Errorf("case %d: expected error, got output %s", i, out.String())
+		} else if out.Len() > 0 {
+			t.Errorf("case %d: output written despite error", i)
+		}
+	}
+}
+
+func TestSaveDeclareNamespaces(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString(`<a xmlns:ns1="urn:taken"><b><c/><d/></b><e/></a>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	doc.SaveDocType = false
+
+	b := doc.SelectNode("", "b")
+	b.Children[0].Name.Space = "urn:x"
+	b.Children[1].SetAttrNS("urn:x", "id", "1")
+	doc.SelectNode("", "e").SetAttrNS("urn:y", "id", "2")
+	doc.SelectNode("", "e").SetAttrNS("urn:z", "id", "3")
+	doc.PreferredPrefixes = map[string]string{"urn:y": "y", "urn:z": "ns1"}
+
+	expected := `<a xmlns:ns1="urn:taken"><b xmlns:ns2="urn:x"><ns2:c /><d ns2:id="1" /></b><e y:id="2" ns3:id="3" xmlns:y="urn:y" xmlns:ns3="urn:z" /></a>`
+	if got := doc.String(); got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", expected, got)
+	}
+
+	if len(b.Attributes) != 0 {
+		t.Errorf("Saving changed the tree: %v", b.Attributes)
+	}
+	if got := b.String(); got != `<b xmlns:ns2="urn:x"><ns2:c /><d ns2:id="1" /></b>` {
+		t.Errorf("Node.String(): %s", got)
+	}
+
+	if _, err := doc.SaveBytesWith(SaveOptions{Strict: true}); err != nil {
+		t.Errorf("SaveBytesWith(): %s", err)
+	}
+
+	doc2 := New()
+	if err := doc2.LoadString(doc.String(), nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	if ok, path := doc2.Root.Equal(doc.Root, EqualOptions{IgnorePrefixes: true}); !ok {
+		t.Errorf("Reloaded document differs at %s", path)
+	}
+
+	// Prefixes without a declaration are kept, as they are by Canonicalize.
+	src := `<p:a><p:b q:x="1" /><c xmlns:ns1="urn:c" /></p:a>`
+	if err := doc.LoadString(src, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	doc.SelectNode("", "c").Name.Space = "urn:d"
+	expected = `<p:a><p:b q:x="1" /><ns2:c xmlns:ns1="urn:c" xmlns:ns2="urn:d" /></p:a>`
+	if got := doc.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, got)
+	}
+}
+
+func TestSaveEncoding(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString(`<a t="é€✓">é€✓</a>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	doc.SaveDocType = false
+
+	tests := []struct {
+		encoding string
+		expected string
+	}{
+		{"US-ASCII", `<a t="&#233;&#8364;&#10003;">&#233;&#8364;&#10003;</a>`},
+		{"ISO-8859-1", "<a t=\"\xe9&#8364;&#10003;\">\xe9&#8364;&#10003;</a>"},
+		{"Windows-1252", "<a t=\"\xe9\x80&#10003;\">\xe9\x80&#10003;</a>"},
+		{"UTF-16LE", "<\x00a\x00 \x00t\x00=\x00\"\x00\xe9\x00\xac \x13'"},
+		{"UTF-16", "\xfe\xff\x00<\x00a"},
+	}
+
+	for _, tt := range tests {
+		doc.Encoding = tt.encoding
+
+		var b bytes.Buffer
+		if err := doc.SaveStream(&b); err != nil {
+			t.Errorf("%s: %s", tt.encoding, err)
+			continue
+		}
+
+		if got := b.String(); !strings.HasPrefix(got, tt.expected) {
+			t.Errorf("%s: expected:\n%q\ngot:\n%q", tt.encoding, tt.expected, got)
+		}
+	}
+
+	doc.Encoding = "ISO-8859-1"
+	doc.Root.Children[0].Name.Local = "é€"
+	if err := doc.SaveStream(ioutil.Discard); err == nil {
+		t.Errorf("Expected an error for a name not representable in ISO-8859-1")
+	}
+	if b := doc.SaveBytes(); b != nil {
+		t.Errorf("SaveBytes(): expected no output for a failed save, got %q", b)
+	}
+
+	a := doc.Root.Children[0]
+	a.Name.Local = "a"
+	a.Children[0].Value += strings.Repeat("x", 8192)
+	a.AddChild(NewNode(NT_ELEMENT))
+	a.Children[1].Name.Local = "€"
+	var out bytes.Buffer
+	if err := doc.SaveWith(&out, SaveOptions{Strict: true}); err == nil || out.Len() > 0 {
+		t.Errorf("Strict save of an unencodable name: %v, %d bytes written", err, out.Len())
+	}
+	a.Children = a.Children[:1]
+	a.Children[0].Value = "é€✓"
+
+	doc.Encoding = "Shift_JIS"
+	doc.SaveDocType = true
+	if s := doc.SaveString(); !strings.Contains(s, `<a t="é€✓">é€✓</a>`) || !strings.Contains(s, `encoding="UTF-8"`) {
+		t.Errorf("Expected utf-8 output for an unsupported encoding, got %q", s)
+	}
+	if _, err := doc.SaveBytesWith(SaveOptions{Strict: true}); err == nil {
+		t.Errorf("Expected an error for an unsupported encoding in strict mode")
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	// Example 3.3 from the Canonical XML 1.0 specification, without the DTD.
+	data := `<?xml version="1.0"?>
+<?xml-stylesheet href="doc.xsl"
+   type="text/xsl"   ?>
+<doc>
+   <e1   />
+   <e2   ></e2>
+   <e3   name = "elem3"   id="elem3"   />
+   <e4   name="elem4"   id="elem4"   ></e4>
+   <e5 a:attr="out" b:attr="sorted" attr2="all" attr="I'm"
+      xmlns:b="http://www.ietf.org"
+      xmlns:a="http://www.w3.org"
+      xmlns="http://example.org"/>
+   <e6 xmlns="" xmlns:a="http://www.w3.org">
+      <e7 xmlns="http://www.ietf.org">
+         <e8 xmlns="" xmlns:a="http://www.w3.org">
+            <e9 xmlns="" xmlns:a="http://www.ietf.org"/>
+         </e8>
+      </e7>
+   </e6>
+   <!-- comment -->
+   <e10 a="&lt;&amp;&quot;&#x9;&#xA;&#xD;">1 &lt; 2 &amp;&amp; 3 &gt; 2</e10>
+</doc>`
+
+	expected := `<?xml-stylesheet href="doc.xsl"
+   type="text/xsl"?>
+<doc>
+   <e1></e1>
+   <e2></e2>
+   <e3 id="elem3" name="elem3"></e3>
+   <e4 id="elem4" name="elem4"></e4>
+   <e5 xmlns="http://example.org" xmlns:a="http://www.w3.org" xmlns:b="http://www.ietf.org" attr="I'm" attr2="all" b:attr="sorted" a:attr="out"></e5>
+   <e6 xmlns:a="http://www.w3.org">
+      <e7 xmlns="http://www.ietf.org">
+         <e8 xmlns="">
+            <e9 xmlns:a="http://www.ietf.org"></e9>
+         </e8>
+      </e7>
+   </e6>
+   %s
+   <e10 a="&lt;&amp;&quot;&#x9;&#xA;&#xD;">1 &lt; 2 &amp;&amp; 3 &gt; 2</e10>
+</doc>`
+
+	doc := New()
+	if err := doc.LoadString(data, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	var b bytes.Buffer
+	if err := doc.Root.Canonicalize(&b, C14N_10); err != nil {
+		t.Fatalf("Canonicalize(): %s", err)
+	}
+	if got, want := b.String(), fmt.Sprintf(expected, ""); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", want, got)
+	}
+
+	b.Reset()
+	if err := doc.Root.Canonicalize(&b, C14N_10_COMMENTS); err != nil {
+		t.Fatalf("Canonicalize(): %s", err)
+	}
+	if got, want := b.String(), fmt.Sprintf(expected, "<!--comment-->"); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", want, got)
+	}
+
+	// Example from the Exclusive XML Canonicalization specification.
+	data = `<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org" xml:lang="nl">
+  <n1:elem2 xmlns:n1="http://example.net" xml:space="preserve">
+    <n3:stuff xmlns:n3="ftp://example.org"/>
+  </n1:elem2>
+</n0:local>`
+
+	if err := doc.LoadString(data, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	elem2 := doc.SelectNode("http://example.net", "elem2")
+	tests := []struct {
+		mode      byte
+		inclusive []string
+		expected  string
+	}{
+		{C14N_10, nil, `<n1:elem2 xmlns:n0="foo:bar" xmlns:n1="http://example.net" xmlns:n3="ftp://example.org" xml:lang="nl" xml:space="preserve">
+    <n3:stuff></n3:stuff>
+  </n1:elem2>`},
+		{C14N_EXCLUSIVE, nil, `<n1:elem2 xmlns:n1="http://example.net" xml:space="preserve">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`},
+		{C14N_EXCLUSIVE, []string{"n0"}, `<n1:elem2 xmlns:n0="foo:bar" xmlns:n1="http://example.net" xml:space="preserve">
+    <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`},
+	}
+
+	for i, tt := range tests {
+		b.Reset()
+		if err := elem2.Canonicalize(&b, tt.mode, tt.inclusive...); err != nil {
+			t.Fatalf("case %d: Canonicalize(): %s", i, err)
+		}
+		if got := b.String(); got != tt.expected {
+			t.Errorf("case %d: expected:\n%s\ngot:\n%s\n", i, tt.expected, got)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	data := `<feed xmlns="urn:feed" xmlns:g="urn:g" lang="en"><title>News</title><entry id="1"><g:count>42</g:count><ok>true</ok></entry><entry id="2"><g:count>007</g:count><ok /></entry></feed>`
+
+	doc := New()
+	if err := doc.LoadString(data, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	tests := []struct {
+		conv     Convention
+		expected string
+	}{
+		{Convention{Style: JSON_SIMPLE, Coerce: true},
+			`{"feed":{"@xmlns":"urn:feed","@xmlns:g":"urn:g","@lang":"en","title":"News","entry":[{"@id":1,"g:count":42,"ok":true},{"@id":2,"g:count":"007","ok":null}]}}`},
+		{Convention{Style: JSON_BADGERFISH},
+			`{"feed":{"@xmlns":{"$":"urn:feed","g":"urn:g"},"@lang":"en","title":{"@xmlns":{"$":"urn:feed","g":"urn:g"},"$":"News"},"entry":[{"@xmlns":{"$":"urn:feed","g":"urn:g"},"@id":"1","g:count":{"@xmlns":{"$":"urn:feed","g":"urn:g"},"$":"42"},"ok":{"@xmlns":{"$":"urn:feed","g":"urn:g"},"$":"true"}},{"@xmlns":{"$":"urn:feed","g":"urn:g"},"@id":"2","g:count":{"@xmlns":{"$":"urn:feed","g":"urn:g"},"$":"007"},"ok":{"@xmlns":{"$":"urn:feed","g":"urn:g"}}}]}}`},
+		{Convention{Style: JSON_PARKER, ForceArray: []string{"title"}, Coerce: true},
+			`{"title":["News"],"entry":[{"g:count":42,"ok":true},{"g:count":"007","ok":null}]}`},
+		{Convention{Style: JSON_GDATA},
+			`{"feed":{"xmlns":"urn:feed","xmlns$g":"urn:g","lang":"en","title":{"$t":"News"},"entry":[{"id":"1","g$count":{"$t":"42"},"ok":{"$t":"true"}},{"id":"2","g$count":{"$t":"007"},"ok":{}}]}}`},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := doc.Root.ToJSON(&b, tt.conv); err != nil {
+			t.Fatalf("style %d: ToJSON(): %s", tt.conv.Style, err)
+		}
+
+		if got := b.String(); got != tt.expected {
+			t.Errorf("style %d: expected:\n%s\ngot:\n%s\n", tt.conv.Style, tt.expected, got)
+			continue
+		}
+
+		n, err := FromJSON(&b, tt.conv)
+		if err != nil {
+			t.Fatalf("style %d: FromJSON(): %s", tt.conv.Style, err)
+		}
+
+		if tt.conv.Style == JSON_PARKER {
+			if n.Name.Local != "root" || n.S("g", "count") != "42" {
+				t.Errorf("style %d: unexpected result %s", tt.conv.Style, n)
+			}
+			continue
+		}
+
+		if v := n.SelectNodes("urn:feed", "entry"); len(v) != 2 || v[1].S("urn:g", "count") != "007" || v[0].As("", "id") != "1" {
+			t.Errorf("style %d: unexpected result %s", tt.conv.Style, n)
+		}
+	}
+}
+
+func TestMap(t *testing.T) {
+	data := `<order xmlns:x="urn:x" id="7"><item>a</item><item sku="2">b</item><x:note>c</x:note><p>Hello <b>world</b>!</p><empty /></order>`
+
+	doc := New()
+	if err := doc.LoadString(data, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	m := doc.SelectNode("", "order").ToMap()
+
+	items, ok := m["item"].([]interface{})
+	if !ok || len(items) != 2 || items[0] != "a" {
+		t.Fatalf("Unexpected items: %#v", m["item"])
+	}
+	if v := items[1].(map[string]interface{}); v["@sku"] != "2" || v["#text"] != "b" {
+		t.Errorf("Unexpected item: %#v", v)
+	}
+	if m["@id"] != "7" || m["@xmlns:x"] != "urn:x" || m["x:note"] != "c" || m["empty"] != "" {
+		t.Errorf("Unexpected map: %#v", m)
+	}
+
+	content := m["p"].(map[string]interface{})["#content"].([]interface{})
+	if len(content) != 3 || content[0] != "Hello " || content[2] != "!" {
+		t.Errorf("Unexpected mixed content: %#v", content)
+	}
+
+	n := FromMap("order", m)
+	expected := `<order id="7" xmlns:x="urn:x"><empty /><item>a</item><item sku="2">b</item><p>Hello <b>world</b>!</p><x:note>c</x:note></order>`
+	if got := n.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, got)
+	}
+
+	if v := n.SelectNode("urn:x", "note"); v == nil {
+		t.Errorf("Prefix was not resolved")
+	}
+}
+
+func TestSaveMinify(t *testing.T) {
+	data := `<?xml version="1.0" encoding="utf-8"?>
+<!-- header -->
+<a xmlns="urn:a" xmlns:b="urn:b">
+	<b:c xmlns:b="urn:b" title='say "hi"'>
+		<d>x &gt; y &amp; z</d>
+	</b:c>
+	<pre xml:space="preserve">
+		<e>  kept  </e>
+	</pre>
+	<e></e>
+	<!-- note -->
+</a>`
+
+	doc := New()
+	if err := doc.LoadString(data, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	got, err := doc.SaveBytesWith(SaveOptions{Minify: true})
+	if err != nil {
+		t.Fatalf("SaveBytesWith(): %s", err)
+	}
+
+	expected := `<?xml version="1.0" encoding="utf-8" standalone="yes"?><a xmlns="urn:a" xmlns:b="urn:b"><b:c title='say "hi"'><d>x > y &amp; z</d></b:c><pre xml:space="preserve">
+		<e>  kept  </e>
+	</pre><e/></a>`
+	if string(got) != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s\n", expected, got)
+	}
+
+	got, err = doc.SaveBytesWith(SaveOptions{Minify: true, KeepComments: true})
+	if err != nil {
+		t.Fatalf("SaveBytesWith(): %s", err)
+	}
+	if !bytes.Contains(got, []byte("?><!--header--><a")) || !bytes.HasSuffix(got, []byte("<e/><!--note--></a>")) {
+		t.Errorf("Comments were not kept:\n%s", got)
+	}
+
+	doc2 := New()
+	if err := doc2.LoadBytes(got, nil); err != nil {
+		t.Fatalf("LoadBytes(): %s", err)
+	}
+	if v := doc2.SelectNode("urn:a", "d").GetValue(); v != "x > y & z" {
+		t.Errorf("Text did not survive a reload: %q", v)
+	}
+}
+
+func TestSaveFileWith(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString(`<a>new</a>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	for _, atomic := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "config.xml")
+		if err := ioutil.WriteFile(path, []byte("<a>old</a>"), 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := doc.SaveFileWith(path, FileOptions{Atomic: atomic, Backup: true, Fsync: true}); err != nil {
+			t.Fatalf("atomic=%v: SaveFileWith(): %s", atomic, err)
+		}
+
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0640 {
+			t.Errorf("atomic=%v: mode was not preserved: %v %v", atomic, fi.Mode(), err)
+		}
+
+		if data, _ := ioutil.ReadFile(path + ".bak"); string(data) != "<a>old</a>" {
+			t.Errorf("atomic=%v: unexpected backup %q", atomic, data)
+		}
+
+		if data, _ := ioutil.ReadFile(path); !bytes.HasSuffix(data, []byte("<a>new</a>")) {
+			t.Errorf("atomic=%v: unexpected content %q", atomic, data)
+		}
+
+		files, _ := ioutil.ReadDir(filepath.Dir(path))
+		if len(files) != 2 {
+			t.Errorf("atomic=%v: temporary file left behind", atomic)
+		}
+
+		if err := doc.SaveFileWith(path, FileOptions{Mode: 0600, Atomic: atomic}); err != nil {
+			t.Fatalf("atomic=%v: SaveFileWith(): %s", atomic, err)
+		}
+		if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+			t.Errorf("atomic=%v: mode was not applied: %v", atomic, fi.Mode())
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := New()
+	if err := a.LoadString(`<list version="1"><!-- items --><item id="a">one</item><item id="b">two</item><item id="c">three</item><old /></list>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	b := New()
+	if err := b.LoadString(`<list version="2" lang="en"><!-- items --><item id="c">three</item><item id="a">one</item><item id="b">2</item><new>x</new></list>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	var report bytes.Buffer
+	if err := WriteReport(&report, Diff(a.Root, b.Root, DiffOptions{})); err != nil {
+		t.Fatalf("WriteReport(): %s", err)
+	}
+
+	expected := `~ /list/@version "1" -> "2"
++ /list/@lang = "en"
+- /list/old <old />
+> /list/item[3] -> /list/item[1]
+~ /list/item[3]/text() "two" -> "2"
++ /list/new <new>x</new>
+`
+	if got := report.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s\n", expected, got)
+	}
+
+	b.SelectNode("", "list").RemoveAttr("lang")
+	b.SelectNode("", "list").SetAttr("lang", "en")
+	b.SelectNode("", "list").RemoveAttr("version")
+	b.SelectNode("", "list").SetAttr("version", "1")
+	changes := Diff(a.Root, b.Root, DiffOptions{IgnoreComments: true})
+	if len(changes) == 0 || changes[0].Type != CH_INSERT || changes[0].Path != "/list/@lang" {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+
+	if changes := Diff(a.Root, a.Root, DiffOptions{}); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString(`<config xmlns:p="urn:p"><servers>
+  <server name="a" />
+  <server name="b" />
+</servers><p:timeout>10</p:timeout><!-- old --></config>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	patch := New()
+	if err := patch.LoadString(`<diff xmlns:q="urn:p">
+  <add sel="/config/servers"><server name="c" /></add>
+  <add sel="/config/servers/server[@name='a']" type="@port">8080</add>
+  <add sel="/config/servers/server[1]" pos="before"><!-- first --></add>
+  <replace sel="/config/q:timeout/text()">30</replace>
+  <replace sel="/config/comment()"><!-- new --></replace>
+  <remove sel="/config/servers/server[@name='b']" ws="before" />
+  <add sel="/config" type="namespace::x">urn:x</add>
+</diff>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	servers := doc.SelectNode("", "servers")
+	if err := doc.ApplyPatch(patch.Root); err != nil {
+		t.Fatalf("ApplyPatch(): %s", err)
+	}
+	if doc.SelectNode("", "servers") != servers {
+		t.Errorf("ApplyPatch() replaced nodes it did not touch")
+	}
+
+	expected := `<config xmlns:p="urn:p" xmlns:x="urn:x"><servers>
+  <!-- first --><server name="a" port="8080" />
+<server name="c" /></servers><p:timeout>30</p:timeout><!-- new --></config>`
+	if got := doc.Root.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	before := doc.Root.String()
+	if err := patch.LoadString(`<diff><add sel="/config" type="@version">2</add><remove sel="/config/missing" /></diff>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	if err := doc.ApplyPatch(patch.Root); err == nil {
+		t.Errorf("expected error for unmatched selector")
+	}
+	if got := doc.Root.String(); got != before {
+		t.Errorf("document modified by failed patch:\n%s", got)
+	}
+
+	a, b := New(), New()
+	if err := a.LoadString(`<list version="1"><!-- items --><item id="a">one</item><item id="b">two</item><item id="c">three</item><old /></list>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	if err := b.LoadString(`<list version="2" lang="en"><!-- items --><item id="c">three</item><item id="a">one</item><item id="b">2</item><new>x</new></list>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	if err := patch.LoadString(MakePatch(a, b, DiffOptions{}).String(), nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	if err := a.ApplyPatch(patch.Root); err != nil {
+		t.Fatalf("ApplyPatch(): %s\n%s", err, patch)
+	}
+	if changes := Diff(a.Root, b.Root, DiffOptions{}); len(changes) != 0 {
+		t.Errorf("patched document differs: %v\n%s", changes, patch)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	load := func(s string) *Node {
+		doc := New()
+		if err := doc.LoadString(s, nil); err != nil {
+			t.Fatalf("LoadString(): %s", err)
+		}
+		return doc.Root
+	}
+
+	tests := []struct {
+		a, b  string
+		opts  EqualOptions
+		equal bool
+		path  string
+	}{
+		{`<a x="1" y="2"><b>t</b></a>`, `<a x="1" y="2"><b>t</b></a>`, EqualOptions{}, true, ""},
+		{`<a x="1" y="2"/>`, `<a y="2" x="1"/>`, EqualOptions{}, false, "/a/@x"},
+		{`<a x="1" y="2"/>`, `<a y="2" x="1"/>`, EqualOptions{IgnoreAttrOrder: true}, true, ""},
+		{`<a x="1"/>`, `<a x="1" y="2"/>`, EqualOptions{IgnoreAttrOrder: true}, false, "/a/@y"},
+		{"<a>\n  <b/>\n</a>", `<a><b/></a>`, EqualOptions{}, false, "/a/text()[1]"},
+		{"<a>\n  <b/>\n</a>", `<a><b/></a>`, EqualOptions{IgnoreWhitespace: true}, true, ""},
+		{`<a>x<!-- c -->y</a>`, `<a>xy</a>`, EqualOptions{IgnoreComments: true}, true, ""},
+		{`<a><?pi data?><b/></a>`, `<a><b/></a>`, EqualOptions{IgnoreProcInst: true}, true, ""},
+		{`<a><b>1.50</b><c>2</c></a>`, `<a><b>1.5</b><c>3</c></a>`, EqualOptions{NormalizeNumbers: true}, false, "/a/c/text()"},
+		{`<p:a xmlns:p="urn:x"/>`, `<q:a xmlns:q="urn:x"/>`, EqualOptions{}, false, "/p:a"},
+		{`<p:a xmlns:p="urn:x"/>`, `<q:a xmlns:q="urn:x"/>`, EqualOptions{IgnorePrefixes: true}, true, ""},
+		{`<a><b/><c/></a>`, `<a><b/></a>`, EqualOptions{}, false, "/a/c"},
+	}
+
+	for i, tt := range tests {
+		equal, path := load(tt.a).Equal(load(tt.b), tt.opts)
+		if equal != tt.equal || path != tt.path {
+			t.Errorf("%d: expected %v %q, got %v %q", i, tt.equal, tt.path, equal, path)
+		}
+	}
+}
+
+func TestMutation(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString(`<a><b/><c/></a>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	a := doc.SelectNode("", "a")
+	b, c := a.Children[0], a.Children[1]
+	elem := func(name string) *Node {
+		n := NewNode(NT_ELEMENT)
+		n.Name.Local = name
+		return n
+	}
+
+	check := func(expected string) {
+		t.Helper()
+		if got := a.String(); got != expected {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+		for _, v := range a.Children {
+			if v.Parent != a {
+				t.Errorf("%s: wrong parent", v.Name.Local)
+			}
+		}
+	}
+
+	a.InsertBefore(elem("x"), c)
+	check(`<a><b /><x /><c /></a>`)
+
+	a.InsertAfter(b, c)
+	check(`<a><x /><c /><b /></a>`)
+
+	a.Prepend(elem("y"))
+	a.InsertAt(100, elem("z"))
+	check(`<a><y /><x /><c /><b /><z /></a>`)
+
+	d := elem("d")
+	c.ReplaceWith(d)
+	if c.Parent != nil {
+		t.Errorf("replaced node still has a parent")
+	}
+	check(`<a><y /><x /><d /><b /><z /></a>`)
+
+	w := elem("w")
+	b.Wrap(w)
+	check(`<a><y /><x /><d /><w><b /></w><z /></a>`)
+	if b.Parent != w {
+		t.Errorf("wrapped node has wrong parent")
+	}
+
+	w.Unwrap()
+	check(`<a><y /><x /><d /><b /><z /></a>`)
+	if b.Parent != a || w.Parent != nil || len(w.Children) != 0 {
+		t.Errorf("unwrap left stale links")
+	}
+
+	b.Detach()
+	d.InsertAt(0, a)
+	if a.Parent != doc.Root || len(d.Children) != 0 {
+		t.Errorf("node inserted into its own descendant")
+	}
+
+	clone := a.Clone()
+	if clone.Parent != nil || clone.String() != a.String() {
+		t.Errorf("clone differs: %s", clone)
+	}
+	clone.SetAttr("k", "v")
+	clone.Children[0].Name.Local = "changed"
+	if a.String() != `<a><y /><x /><d /><z /></a>` {
+		t.Errorf("clone shares state with original: %s", a)
+	}
+	for _, v := range clone.Children {
+		if v.Parent != clone {
+			t.Errorf("clone child has wrong parent")
+		}
+	}
+
+	if s := a.ShallowClone(); len(s.Children) != 0 || s.Name != a.Name {
+		t.Errorf("unexpected shallow clone: %s", s)
+	}
+}
+
+func TestAttrNS(t *testing.T) {
+	const xlink = "http://www.w3.org/1999/xlink"
+
+	doc := New()
+	if err := doc.LoadString(`<a xmlns:xlink="http://www.w3.org/1999/xlink" href="local" xlink:href="remote" />`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	a := doc.SelectNode("", "a")
+	a.SetAttrNS(xlink, "href", "other")
+	a.SetAttr("href", "plain")
+	if a.As("", "href") != "plain" || a.As(xlink, "href") != "other" {
+		t.Errorf("setters clobbered each other: %s", a)
+	}
+
+	if attr := a.Attr(xlink, "href"); attr == nil || attr.Value != "other" {
+		t.Errorf("Attr(): unexpected %v", attr)
+	}
+
+	a.RemoveAttrNS(xlink, "href")
+	if a.HasAttr(xlink, "href") || !a.HasAttr("", "href") {
+		t.Errorf("RemoveAttrNS removed the wrong attribute: %s", a)
+	}
+
+	// Adjacent duplicates must all be removed.
+	a.Attributes = append(a.Attributes, &Attr{Name: xml.Name{Local: "d"}}, &Attr{Name: xml.Name{Local: "d"}})
+	a.RemoveAttr("d")
+	if a.HasAttr("", "d") {
+		t.Errorf("RemoveAttr skipped a duplicate: %s", a)
+	}
+
+	a.SetAttrInt("", "i", -42)
+	a.SetAttrUint("", "u", 42)
+	a.SetAttrFloat("", "f", 1.5)
+	a.SetAttrBool("", "b", true)
+	a.SetAttrTime("", "t", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	if a.Ai("", "i") != -42 || a.Au("", "u") != 42 || a.Af64("", "f") != 1.5 || !a.Ab("", "b") {
+		t.Errorf("typed setters do not round trip: %s", a)
+	}
+	if s := a.As("", "t"); s != "2020-01-02T03:04:05Z" {
+		t.Errorf("SetAttrTime(): unexpected %q", s)
+	}
+
+	count := len(a.Attributes)
+	a.SetAttrNS("*", "i", "1")
+	a.SetAttrNS("*", "new", "1")
+	if len(a.Attributes) != count || a.As("", "i") != "-42" {
+		t.Errorf("SetAttrNS() with a wildcard changed the attributes: %s", a)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	const xlink = "http://www.w3.org/1999/xlink"
+
+	doc := New().Build(
+		E("urn:shop", "order").Attr("id", "1").Child(
+			E("urn:shop", "item").Text("x").AttrNS(xlink, "href", "#a"),
+			E("", "note").Comment("c").Text("y"),
+			E("urn:other", "o").NS("p", "urn:other").Child(E("urn:other", "inner")),
+		),
+	)
+
+	expected := `<order id="1" xmlns="urn:shop"><item ns1:href="#a" xmlns:ns1="http://www.w3.org/1999/xlink">x</item><note xmlns=""><!-- c -->y</note><p:o xmlns:p="urn:other"><p:inner /></p:o></order>`
+	if got := doc.Root.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// An explicit default namespace is kept; the element gets a prefix.
+	n := E("urn:a", "a").NS("", "urn:b").Child(E("urn:b", "b")).Node()
+	expected = `<ns1:a xmlns="urn:b" xmlns:ns1="urn:a"><b /></ns1:a>`
+	if got := n.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	root := NewNode(NT_ELEMENT)
+	root.Name.Local = "r"
+	if doc = NewDocumentWithRoot(root); doc.SelectNode("", "r") != root || root.Parent != doc.Root {
+		t.Errorf("NewDocumentWithRoot(): unexpected tree %s", doc)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString(`<a x="1"><b>text</b><c /></a>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	original := doc.Root.String()
+	a := doc.SelectNode("", "a")
+	b, c := a.Children[0], a.Children[1]
+
+	edit := func() {
+		a.SetAttr("x", "2")
+		a.SetAttr("y", "3")
+		a.RemoveAttr("x")
+		b.SetValue("changed")
+		c.Wrap(NewNode(NT_ELEMENT))
+		a.Prepend(c)
+		b.Detach()
+	}
+
+	tx := doc.Begin()
+	edit()
+	modified := doc.Root.String()
+	if modified == original {
+		t.Fatalf("edit did not change the document")
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback(): %s", err)
+	}
+	if got := doc.Root.String(); got != original {
+		t.Errorf("rollback: expected %s, got %s", original, got)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Errorf("expected error committing a finished transaction")
+	}
+
+	tx = doc.Begin()
+	inner := doc.Begin()
+	edit()
+	if err := tx.Commit(); err == nil {
+		t.Errorf("expected error committing with a nested transaction open")
+	}
+	if err := inner.Commit(); err != nil {
+		t.Fatalf("Commit(): %s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit(): %s", err)
+	}
+
+	if got := doc.Root.String(); got != modified {
+		t.Errorf("commit: expected %s, got %s", modified, got)
+	}
+
+	if !doc.Undo() || doc.Root.String() != original {
+		t.Errorf("undo: got %s", doc.Root)
+	}
+	if doc.Undo() {
+		t.Errorf("undo with empty history succeeded")
+	}
+	if !doc.Redo() || doc.Root.String() != modified {
+		t.Errorf("redo: got %s", doc.Root)
+	}
+
+	a.SetAttr("z", "1")
+	if !doc.Undo() || a.HasAttr("", "z") || doc.Root.String() != modified {
+		t.Errorf("undo of single change: got %s", doc.Root)
+	}
+
+	patch := New()
+	if err := patch.LoadString(`<diff><add sel="/a" type="@p">v</add><remove sel="/a/missing" /></diff>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	if err := doc.ApplyPatch(patch.Root); err == nil || doc.Root.String() != modified {
+		t.Errorf("failed patch changed the document: %s", doc.Root)
+	}
+	if err := patch.LoadString(`<diff><add sel="/a" type="@p">v</add></diff>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	if err := doc.ApplyPatch(patch.Root); err != nil {
+		t.Fatalf("ApplyPatch(): %s", err)
+	}
+	if !doc.Undo() || doc.Root.String() != modified {
+		t.Errorf("undo of patch: got %s", doc.Root)
+	}
+
+	// Changes which were not recorded make undoing fail instead of panic.
+	a = doc.SelectNode("", "a")
+	for i := 0; i < 2; i++ {
+		a.AddChild(NewNode(NT_COMMENT))
+	}
+	a.Children = a.Children[:1]
+	expected := a.String()
+	if doc.Undo() || a.String() != expected {
+		t.Errorf("Undo() of an unrecorded change: got %s", a)
+	}
+
+	tx = doc.Begin()
+	a.AddChild(NewNode(NT_COMMENT))
+	a.SetAttr("q", "1")
+	a.Attributes = nil
+	if err := tx.Rollback(); err == nil {
+		t.Errorf("Rollback() of an unrecorded change: expected an error")
+	}
+
+	n := 0
+	doc.Observe(func(MutationRecord) { n++ })
+	a.RemoveNameSpace()
+	a.Name.Space = "urn:x"
+	a.RemoveNameSpace()
+	if n != 1 {
+		t.Errorf("RemoveNameSpace(): expected 1 record, got %d", n)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString(`<a x="1"><b>text</b></a>`, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	var log []string
+	stop := doc.Observe(func(r MutationRecord) {
+		var s string
+		switch r.Type {
+		case MR_INSERT:
+			s = fmt.Sprintf("insert %s %d", r.Child.Name.Local, r.Index)
+		case MR_REMOVE:
+			s = fmt.Sprintf("remove %s %d", r.Child.Name.Local, r.Index)
+		case MR_ATTR_ADD:
+			s = fmt.Sprintf("add @%s=%s", r.Attr.Name.Local, r.NewValue)
+		case MR_ATTR_REMOVE:
+			s = fmt.Sprintf("remove @%s=%s", r.Attr.Name.Local, r.OldValue)
+		case MR_ATTR_SET:
+			s = fmt.Sprintf("set @%s %s->%s", r.Attr.Name.Local, r.OldValue, r.NewValue)
+		case MR_VALUE:
+			s = fmt.Sprintf("value %s->%s", r.OldValue, r.NewValue)
+		}
+		if r.Replay {
+			s += " (replay)"
+		}
+		log = append(log, s)
+	})
+
+	a := doc.SelectNode("", "a")
+	b := a.Children[0]
+	c := NewNode(NT_ELEMENT)
+	c.Name.Local = "c"
+
+	tx := doc.Begin()
+	a.SetAttr("x", "2")
+	a.SetAttr("y", "3")
+	a.RemoveAttr("x")
+	b.Children[0].SetValue("new")
+	a.InsertBefore(c, b)
+	b.Detach()
+	tx.Rollback()
+
+	expected := []string{
+		"set @x 1->2",
+		"add @y=3",
+		"remove @x=2",
+		"value text->new",
+		"insert c 0",
+		"remove b 1",
+		"insert b 1 (replay)",
+		"remove c 0 (replay)",
+		"value new->text (replay)",
+		"add @x=2 (replay)",
+		"remove @y=3 (replay)",
+		"set @x 2->1 (replay)",
+	}
+	if strings.Join(log, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(log, "\n"))
+	}
+
+	// Detached nodes are not part of the document.
+	log = nil
+	c.SetAttr("z", "1")
+	stop()
+	a.SetAttr("z", "1")
+	if len(log) != 0 {
+		t.Errorf("unexpected records: %v", log)
+	}
+
+	// Observers stay attached when the document is reloaded, and only
+	// observing it does not record history.
+	doc = New()
+	n := 0
+	doc.Observe(func(MutationRecord) { n++ })
+	if err := doc.LoadString(`<a/>`, nil); err != nil || n != 1 {
+		t.Errorf("LoadString(): %v, %d records", err, n)
+	}
+
+	patch := New()
+	patch.LoadString(`<diff><add sel="/a"><b/></add></diff>`, nil)
+	if err := doc.ApplyPatch(patch.Root); err != nil || n != 2 {
+		t.Errorf("ApplyPatch(): %v, %d records", err, n)
+	}
+	if doc.Undo() {
+		t.Errorf("Undo(): history recorded for an observed document")
+	}
+
+	tx = doc.Begin()
+	doc.LoadString(`<c/>`, nil)
+	doc.Build(E("", "d"))
+	tx.Rollback()
+	if s := doc.Root.String(); s != `<a><b /></a>` {
+		t.Errorf("Rollback() of a reload: got %s", s)
+	}
+}
+
+func TestTextContent(t *testing.T) {
+	doc := New()
+	if err := doc.LoadString("<a> one <b>two<!-- c --> <c>three</c></b>\tfour\n</a>", nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+
+	a := doc.SelectNode("", "a")
+	if s := a.TextContent(); s != " one two three\tfour\n" {
+		t.Errorf("TextContent(): unexpected %q", s)
+	}
+	if s := a.TextContentWS(WS_REPLACE); s != " one two three four " {
+		t.Errorf("WS_REPLACE: unexpected %q", s)
+	}
+	if s := a.TextContentWS(WS_COLLAPSE); s != "one two three four" {
+		t.Errorf("WS_COLLAPSE: unexpected %q", s)
+	}
+
+	b := a.SelectNode("", "b")
+	b.SetTextContent("new")
+	if len(b.Children) != 1 || b.TextContent() != "new" {
+		t.Errorf("SetTextContent(): unexpected %s", b)
+	}
+	b.SetTextContent("")
+	if len(b.Children) != 0 {
+		t.Errorf("SetTextContent(\"\"): unexpected %s", b)
+	}
+
+	for _, s := range []string{"x", "", "y", "z"} {
+		n := NewNode(NT_TEXT)
+		n.Value = s
+		b.AddChild(n)
+	}
+	c := NewNode(NT_ELEMENT)
+	c.Name.Local = "c"
+	b.AddChild(c)
+	n := NewNode(NT_TEXT)
+	b.AddChild(n)
+
+	b.Normalize()
+	if len(b.Children) != 2 || b.Children[0].Value != "xyz" || b.Children[1] != c {
+		t.Errorf("Normalize(): unexpected %s", b)
+	}
+}
+
+func TestNamespaceTools(t *testing.T) {
+	load := func(s string) *Node {
+		doc := New()
+		if err := doc.LoadString(s, nil); err != nil {
+			t.Fatalf("LoadString(): %s", err)
+		}
+		return doc.Root
+	}
+
+	root := load(`<a xmlns="urn:old" xmlns:o="urn:old"><b o:x="1"/></a>`)
+	root.RenameNamespace("urn:old", "urn:new")
+	if s := root.String(); s != `<a xmlns="urn:new" xmlns:o="urn:new"><b o:x="1" /></a>` {
+		t.Errorf("RenameNamespace(): unexpected %s", s)
+	}
+	if b := root.SelectNode("urn:new", "b"); b == nil || !b.HasAttr("urn:new", "x") {
+		t.Errorf("RenameNamespace(): names not updated")
+	}
+
+	root = load(`<p:a xmlns:p="urn:p" xmlns:q="urn:q"><p:b p:x="1"/></p:a>`)
+	if err := root.ChangePrefix("p", "q"); err == nil {
+		t.Errorf("ChangePrefix(): expected error for declared prefix")
+	}
+	if err := root.ChangePrefix("p", "r"); err != nil {
+		t.Fatalf("ChangePrefix(): %s", err)
+	}
+	if s := root.String(); s != `<r:a xmlns:r="urn:p" xmlns:q="urn:q"><r:b r:x="1" /></r:a>` {
+		t.Errorf("ChangePrefix(): unexpected %s", s)
+	}
+
+	root = load(`<a xmlns:p="urn:p"><b xmlns:p="urn:p" xmlns:q="urn:q"><q:c/></b><d xmlns:q="urn:other"><q:e/></d><f xmlns:p="urn:x"><g xmlns:s="urn:s"/></f></a>`)
+	root.HoistNamespaceDeclarations()
+	expected := `<a xmlns:p="urn:p" xmlns:q="urn:q" xmlns:s="urn:s"><b><q:c /></b><d xmlns:q="urn:other"><q:e /></d><f xmlns:p="urn:x"><g /></f></a>`
+	if s := root.String(); s != expected {
+		t.Errorf("HoistNamespaceDeclarations():\nexpected %s\ngot      %s", expected, s)
+	}
+
+	root = load(`<a xmlns="urn:d" xmlns:p="urn:p" xmlns:u="urn:u"><b xmlns:p="urn:p2"><c p:x="1"/></b><p:d/></a>`)
+	root.RemoveUnusedNamespaceDeclarations()
+	expected = `<a xmlns="urn:d" xmlns:p="urn:p"><b xmlns:p="urn:p2"><c p:x="1" /></b><p:d /></a>`
+	if s := root.String(); s != expected {
+		t.Errorf("RemoveUnusedNamespaceDeclarations():\nexpected %s\ngot      %s", expected, s)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	doc := New()
+	src := `<catalog xmlns:x="urn:x"><book id="1"><title>A</title><old/></book>` +
+		`<book id="2"><title>B</title><x:note/></book><book id="3"><title>C</title></book></catalog>`
+	if err := doc.LoadString(src, nil); err != nil {
+		t.Fatalf("LoadString(): %s", err)
+	}
+	doc.SaveDocType = false
+	tx := doc.Begin()
+
+	visited := 0
+	Transform(doc.Root,
+		MatchName("", "old", Delete),
+		MatchPath("/catalog/book", func(n *Node) []*Node {
+			visited++
+			if n.As("", "id") == "2" {
+				// Removing a sibling which was not visited yet.
+				n.Parent.Children[2].Detach()
+			}
+			return []*Node{n}
+		}),
+		MatchPath("book/title", func(n *Node) []*Node {
+			e := NewNode(NT_ELEMENT)
+			e.Name.Local = "name"
+			e.AddChild(n.Children[0])
+			return []*Node{e}
+		}),
+		MatchPath("{urn:x}note", func(n *Node) []*Node {
+			c := NewNode(NT_COMMENT)
+			c.Value = "note"
+			return []*Node{c, n.Parent.Children[0]}
+		}),
+	)
+	tx.Commit()
+
+	expected := `<catalog xmlns:x="urn:x"><book id="1"><name>A</name></book><book id="2"><!-- note --><name>B</name></book></catalog>`
+	if s := doc.String(); s != expected {
+		t.Errorf("Transform():\nexpected %s\ngot      %s", expected, s)
+	}
+	if visited != 2 {
+		t.Errorf("Expected 2 books to be visited, got %d", visited)
+	}
+
+	if !doc.Undo() {
+		t.Fatalf("Undo() failed")
+	}
+	if s := doc.String(); s != strings.Replace(src, "/>", " />", -1) {
+		t.Errorf("Undo():\ngot %s", s)
+	}
+
+	e := NewNode(NT_ELEMENT)
+	e.Name.Local = "a"
+	list := Transform(e, MatchFunc(func(n *Node) bool { return n.Parent == nil }, func(n *Node) []*Node {
+		return []*Node{NewNode(NT_COMMENT), n}
+	}))
+	if len(list) != 2 || list[1] != e || e.Parent != nil {
+		t.Errorf("Transform() of a root returned %v", list)
+	}
+
+	// Replacements may include siblings of the node they replace.
+	tests := []struct {
+		src, expected string
+		replace       func(n *Node) []*Node
+	}{
+		{`<p><a/><n/><c/></p>`, `<p><a /><n /><c /></p>`, func(n *Node) []*Node {
+			return []*Node{n.Parent.Children[0], n}
+		}},
+		{`<p><a/><b/><n/><c/></p>`, `<p><b /><x /><a /><c /></p>`, func(n *Node) []*Node {
+			x := NewNode(NT_ELEMENT)
+			x.Name.Local = "x"
+			return []*Node{x, n.Parent.Children[0]}
+		}},
+		{`<p><a/><n/><c/></p>`, `<p><a /><c /><n /></p>`, func(n *Node) []*Node {
+			return []*Node{n.Parent.Children[2], n}
+		}},
+		{`<p><a/><n/><c/><d/></p>`, `<p><a /><x /><d /></p>`, func(n *Node) []*Node {
+			n.Parent.Children[2].Detach()
+			n.Detach()
+			x := NewNode(NT_ELEMENT)
+			x.Name.Local = "x"
+			return []*Node{x}
+		}},
+	}
+
+	for i, tt := range tests {
+		doc := New()
+		if err := doc.LoadString(tt.src, nil); err != nil {
+			t.Fatalf("LoadString(): %s", err)
+		}
+		Transform(doc.Root, MatchName("", "n", tt.replace), Rule{})
+		if s := doc.Root.String(); s != tt.expected {
+			t.Errorf("case %d: expected %s, got %s", i, tt.expected, s)
+		}
+	}
+}